@@ -0,0 +1,342 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrPAXPrefix prefixes extended attributes in the PAX records of a tar
+// entry, the way GNU tar and Docker store them
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// writeTar writes path, a file or directory tree inside root, to w as a tar
+// stream whose entries are named after name. Symlinks are archived, not
+// followed, except in the directories leading up to path, which are resolved
+// the way a process chrooted to root would.
+func writeTar(w io.Writer, root, path, name string) error {
+	dir, err := resolveInRoot(root, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	src := filepath.Join(dir, filepath.Base(path))
+	if filepath.Base(path) == "/" {
+		// Roots under /proc are symlinks, walk what they point to
+		src = strings.TrimSuffix(dir, "/") + "/"
+	}
+
+	tw := tar.NewWriter(w)
+	hardlinks := make(map[[2]uint64]string) // Device and inode to the first entry linking them
+	err = filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		return writeTarEntry(tw, file, filepath.Join(name, rel), info, hardlinks)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %v", path, err)
+	}
+
+	return tw.Close()
+}
+
+// writeTarEntry writes a single file's header and contents
+func writeTarEntry(tw *tar.Writer, file, name string, info os.FileInfo, hardlinks map[[2]uint64]string) error {
+	// Sockets only make sense to the process listening on them
+	if info.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// The names of the host's users mean nothing for the container's files
+	hdr.Uname, hdr.Gname = "", ""
+
+	xattrs, err := readXattrs(file)
+	if err != nil {
+		return err
+	}
+	for attr, value := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[xattrPAXPrefix+attr] = value
+	}
+
+	// Files with several links are stored once and linked to from then on
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 {
+		key := [2]uint64{st.Dev, st.Ino}
+		if first, ok := hardlinks[key]; ok {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+		} else {
+			hardlinks[key] = name
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractTar unpacks a tar stream into dest inside root, keeping ownership,
+// permissions and modification times. Every entry is resolved the way a
+// process chrooted to root would, so symlinks in root or in the archive
+// can't point the extraction outside of it. Unless rename is empty, it
+// replaces the first component of every entry's name.
+func extractTar(r io.Reader, root, dest, rename string) error {
+	// Directory times change while their contents are written, set them last
+	type dirTimes struct {
+		path  string
+		atime time.Time
+		mtime time.Time
+	}
+	var dirs []dirTimes
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+
+		name := filepath.Clean(strings.TrimLeft(hdr.Name, "/"))
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("archive entry %s is outside of the destination", hdr.Name)
+		}
+		if name == "." {
+			continue
+		}
+		if rename != "" {
+			name = renameFirst(name, rename)
+			if hdr.Typeflag == tar.TypeLink {
+				hdr.Linkname = renameFirst(filepath.Clean(strings.TrimLeft(hdr.Linkname, "/")), rename)
+			}
+		}
+
+		parent, err := resolveInRoot(root, filepath.Join(dest, filepath.Dir(name)))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %v", name, err)
+		}
+		target := filepath.Join(parent, filepath.Base(name))
+
+		if err := extractTarEntry(tr, hdr, root, dest, target); err != nil {
+			return fmt.Errorf("failed to extract %s: %v", name, err)
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{target, hdr.AccessTime, hdr.ModTime})
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		setFileTimes(dirs[i].path, dirs[i].atime, dirs[i].mtime)
+	}
+
+	return nil
+}
+
+// renameFirst replaces the first component of a relative path
+func renameFirst(path, name string) string {
+	parts := strings.SplitN(path, "/", 2)
+	parts[0] = name
+	return strings.Join(parts, "/")
+}
+
+// extractTarEntry creates target from a single archive entry
+func extractTarEntry(tr *tar.Reader, hdr *tar.Header, root, dest, target string) error {
+	existing, err := os.Lstat(target)
+	if err == nil && !(existing.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if existing.IsDir() {
+			return fmt.Errorf("cannot overwrite directory with a non-directory")
+		}
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		return extractSymlink(hdr, target)
+	case tar.TypeLink:
+		linkName := filepath.Clean(strings.TrimLeft(hdr.Linkname, "/"))
+		if linkName == ".." || strings.HasPrefix(linkName, "../") {
+			return fmt.Errorf("hard link to %s is outside of the destination", hdr.Linkname)
+		}
+		source, err := resolveInRoot(root, filepath.Join(dest, linkName))
+		if err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := uint32(syscall.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			mode = syscall.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			mode = syscall.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(target, mode, int(dev)); err != nil {
+			return err
+		}
+	default:
+		logDebug("Skipping %s of unsupported type %c", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	// chown clears the setuid and setgid bits and file capabilities, so it
+	// goes first
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := writeXattrs(target, hdr); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		setFileTimes(target, hdr.AccessTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// extractSymlink creates a symlink entry, owned like the original
+func extractSymlink(hdr *tar.Header, target string) error {
+	if err := os.Symlink(hdr.Linkname, target); err != nil {
+		return err
+	}
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := writeXattrs(target, hdr); err != nil {
+		return err
+	}
+	setFileTimes(target, hdr.AccessTime, hdr.ModTime)
+	return nil
+}
+
+// readXattrs returns the extended attributes of file, without following
+// symlinks. The ones overlayfs keeps its own bookkeeping in are left out.
+func readXattrs(file string) (map[string]string, error) {
+	size, err := unix.Llistxattr(file, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list extended attributes: %v", err)
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(file, buf); err != nil {
+		return nil, fmt.Errorf("failed to list extended attributes: %v", err)
+	}
+
+	xattrs := make(map[string]string)
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if attr == "" || strings.HasPrefix(attr, "trusted.overlay.") {
+			continue
+		}
+
+		size, err := unix.Lgetxattr(file, attr, nil)
+		if err == unix.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read extended attribute %s: %v", attr, err)
+		}
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(file, attr, value); err != nil {
+			return nil, fmt.Errorf("failed to read extended attribute %s: %v", attr, err)
+		}
+		xattrs[attr] = string(value[:size])
+	}
+	return xattrs, nil
+}
+
+// writeXattrs sets the extended attributes recorded in an archive entry on
+// target, without following symlinks
+func writeXattrs(target string, hdr *tar.Header) error {
+	for key, value := range hdr.PAXRecords {
+		attr := strings.TrimPrefix(key, xattrPAXPrefix)
+		if attr == key {
+			continue
+		}
+		if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil {
+			return fmt.Errorf("failed to set extended attribute %s: %v", attr, err)
+		}
+	}
+	return nil
+}
+
+// setFileTimes sets the access and modification times of path without
+// following symlinks. Archives without access times get the modification time.
+func setFileTimes(path string, atime, mtime time.Time) {
+	if atime.IsZero() {
+		atime = mtime
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		logDebug("Failed to set times of %s: %v", path, err)
+	}
+}
@@ -9,6 +9,9 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -23,6 +26,7 @@ type CgroupConfig struct {
 	MemoryLimit string
 	CPUQuota    string
 	CPUPeriod   string
+	Devices     []deviceRule // Devices the processes may use, nil for no restriction
 }
 
 // NewDefaultCgroupConfig returns a cgroup config with sensible defaults
@@ -36,6 +40,11 @@ func NewDefaultCgroupConfig() *CgroupConfig {
 	}
 }
 
+// containerCgroupName returns the name of a container's own cgroup
+func containerCgroupName(id string) string {
+	return filepath.Join(cgroupName, id)
+}
+
 // SetupCgroups creates and configures cgroups for the container
 func SetupCgroups(config *CgroupConfig) error {
 	cgroupPath := filepath.Join(cgroupBasePath, config.Name)
@@ -47,6 +56,15 @@ func SetupCgroups(config *CgroupConfig) error {
 		}
 	}
 
+	// A nested cgroup only gets the controllers its parent hands down
+	if parent := filepath.Dir(cgroupPath); parent != cgroupBasePath && isCgroup2(parent) {
+		for _, controller := range []string{"pids", "memory", "cpu"} {
+			if err := setCgroupValue(parent, "cgroup.subtree_control", "+"+controller); err != nil {
+				logDebug("Controller %s not available: %v", controller, err)
+			}
+		}
+	}
+
 	// Set process limits
 	if err := setCgroupValue(cgroupPath, "pids.max", config.MaxPids); err != nil {
 		return fmt.Errorf("failed to set pids.max: %v", err)
@@ -73,9 +91,44 @@ func SetupCgroups(config *CgroupConfig) error {
 		return fmt.Errorf("failed to add process to cgroup: %v", err)
 	}
 
+	// Restrict device access
+	if config.Devices != nil {
+		if err := setupDeviceCgroup(config); err != nil {
+			return fmt.Errorf("failed to restrict devices: %v", err)
+		}
+	}
+
 	return nil
 }
 
+// setupDeviceCgroup limits the current process to the allowed devices, with an
+// eBPF program on cgroup v2 or the devices controller on cgroup v1
+func setupDeviceCgroup(config *CgroupConfig) error {
+	cgroupPath := filepath.Join(cgroupBasePath, config.Name)
+	if isCgroup2(cgroupPath) {
+		return setDeviceCgroupV2(cgroupPath, config.Devices)
+	}
+
+	devicesPath := filepath.Join(cgroupBasePath, "devices", config.Name)
+	if !dirExists(filepath.Join(cgroupBasePath, "devices")) {
+		logInfo("No device cgroup available, device access is not restricted")
+		return nil
+	}
+	if err := os.MkdirAll(devicesPath, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup directory %s: %v", devicesPath, err)
+	}
+	if err := setDeviceCgroupV1(devicesPath, config.Devices); err != nil {
+		return err
+	}
+	return setCgroupValue(devicesPath, "cgroup.procs", strconv.Itoa(os.Getpid()))
+}
+
+// isCgroup2 reports whether path is on a cgroup v2 filesystem
+func isCgroup2(path string) bool {
+	var st syscall.Statfs_t
+	return syscall.Statfs(path, &st) == nil && st.Type == unix.CGROUP2_SUPER_MAGIC
+}
+
 // CleanupCgroups removes the cgroup (optional, as it will be cleaned up automatically)
 func CleanupCgroups(config *CgroupConfig) error {
 	cgroupPath := filepath.Join(cgroupBasePath, config.Name)
@@ -85,9 +138,21 @@ func CleanupCgroups(config *CgroupConfig) error {
 		return fmt.Errorf("failed to remove cgroup directory: %v", err)
 	}
 
+	// And the cgroup v1 device cgroup
+	if err := os.RemoveAll(filepath.Join(cgroupBasePath, "devices", config.Name)); err != nil {
+		return fmt.Errorf("failed to remove device cgroup directory: %v", err)
+	}
+
 	return nil
 }
 
+// removeContainerCgroup deletes the cgroups of a container that has exited
+func removeContainerCgroup(id string) {
+	if err := CleanupCgroups(&CgroupConfig{Name: containerCgroupName(id)}); err != nil {
+		logError("Failed to remove cgroup: %v", err)
+	}
+}
+
 // setCgroupValue writes a value to a cgroup file
 func setCgroupValue(cgroupPath, filename, value string) error {
 	filePath := filepath.Join(cgroupPath, filename)
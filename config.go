@@ -1,39 +1,246 @@
 package main
 
 import (
+	"encoding/csv"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // ContainerConfig holds configuration for the container
 type ContainerConfig struct {
-	Hostname     string
-	RootFS       string
-	Mounts       []Mount
-	NetworkCIDR  string
-	HostIP       string
-	ContainerIP  string
-	Command      []string
+	ID             string
+	Name           string // Optional, unique among running containers
+	Hostname       string
+	RootFS         string
+	Mounts         []Mount
+	Devices        []Device // Host devices passed through with --device
+	ShmSize        uint64   // Size of /dev/shm in bytes
+	WritableSys    bool     // Mount /sys and /sys/fs/cgroup read-write
+	ReadOnly       bool     // Mount the rootfs read-only, tmpfs and bind mounts stay writable
+	StorageSize    uint64   // Size of the writable layer over the rootfs in bytes, 0 to write to the rootfs
+	Ports          []PortMapping
+	Network        string   // Name of the network to attach to
+	NetworkAliases []string // Extra names the container resolves as on its network
+	NetworkCIDR    string
+	Driver         string // Driver of the network, see networks.go
+	Bridge         string
+	HostIP         string
+	ContainerIP    string
+	IPv6CIDR       string // Empty unless the network is dual-stack
+	IPv6Gateway    string
+	ContainerIPv6  string
+	DHCPLease      *DHCPLease // Set when the address was leased from the LAN's DHCP server
+	EgressIface    string     // Host interface to masquerade through, detected if empty
+	EgressIfaces   []string   // Interfaces the NAT rules were installed for
+	EgressIfacesV6 []string   // Same as EgressIfaces, for IPv6 traffic
+	DNS            []string   // Nameservers, inherited from the host if empty
+	DNSSearch      []string   // Search domains, inherited from the host if empty
+	DNSOptions     []string   // resolv.conf options, inherited from the host if empty
+	ExtraHosts     []HostEntry
+	EmbeddedDNS    string // Address of the network's DNS server, empty if it has none
+	Shaping        NetworkShaping
+	DenyEgress     bool         // Drop outbound traffic that AllowEgress doesn't allow
+	AllowEgress    []EgressRule // Destinations reachable despite DenyEgress
+	Command        []string
+	HostVeth       string // Host side of the veth pair, derived from ID
+	PeerVeth       string // Container side of the veth pair before it is renamed to eth0
 }
 
-// Mount represents a bind mount from host to container
+// Mount types
+const (
+	mountBind   = "bind"
+	mountTmpfs  = "tmpfs"
+	mountVolume = "volume"
+)
+
+// readOnlyTmpfsPaths get a tmpfs in containers with a read-only rootfs,
+// unless something else is mounted there
+var readOnlyTmpfsPaths = []string{"/tmp", "/run", "/var/tmp"}
+
+// mountPropagations are the accepted bind propagation modes, see mount(8)
+var mountPropagations = []string{"private", "rprivate", "shared", "rshared", "slave", "rslave"}
+
+// Mount represents a bind mount, tmpfs or named volume in the container
 type Mount struct {
-	Source      string // Host path
-	Destination string // Container path
-	ReadOnly    bool
+	Type         string // bind, tmpfs or volume, empty means bind
+	Source       string // Host path or volume name, unused for tmpfs
+	Destination  string // Container path
+	ReadOnly     bool
+	NonRecursive bool        // Leave out the mounts below Source
+	Propagation  string      // Bind propagation, rprivate if empty
+	TmpfsSize    string      // Size limit such as 64m, the kernel's default of half the RAM if empty
+	TmpfsMode    os.FileMode // Permissions of the tmpfs root, 1777 if 0
+	Options      []string    // Mount flags such as nosuid, nodev and noexec
+	IDMap        []IDMapping // Ownership mapping of an idmapped bind, none if empty
+
+	usernsFd int // User namespace carrying the IDMap, received by the child
+}
+
+// IDMapping maps a range of container user and group IDs to host IDs, the
+// way a line of /proc/PID/uid_map does
+type IDMapping struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+// String formats the mapping the way idmap= takes it, e.g. "0:1000:1"
+func (m IDMapping) String() string {
+	return fmt.Sprintf("%d:%d:%d", m.ContainerID, m.HostID, m.Size)
+}
+
+// String formats the mount in the key/value syntax of --mount
+func (m Mount) String() string {
+	fields := []string{"type=" + m.mountType()}
+	if m.Source != "" {
+		fields = append(fields, "source="+m.Source)
+	}
+	fields = append(fields, "target="+m.Destination)
+	if m.ReadOnly {
+		fields = append(fields, "readonly")
+	}
+	if m.NonRecursive {
+		fields = append(fields, "bind-recursive=disabled")
+	}
+	if m.Propagation != "" {
+		fields = append(fields, "bind-propagation="+m.Propagation)
+	}
+	if m.TmpfsSize != "" {
+		fields = append(fields, "tmpfs-size="+m.TmpfsSize)
+	}
+	if m.TmpfsMode != 0 {
+		fields = append(fields, fmt.Sprintf("tmpfs-mode=%o", m.TmpfsMode))
+	}
+	if len(m.Options) > 0 {
+		fields = append(fields, "options="+strings.Join(m.Options, ","))
+	}
+	for _, mapping := range m.IDMap {
+		fields = append(fields, "idmap="+mapping.String())
+	}
+
+	// Quote fields the way encoding/csv does, paths may contain commas
+	var buf strings.Builder
+	writer := csv.NewWriter(&buf)
+	writer.Write(fields)
+	writer.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// mountType returns the type of the mount, mounts recorded before types existed are binds
+func (m Mount) mountType() string {
+	if m.Type == "" {
+		return mountBind
+	}
+	return m.Type
+}
+
+// Device is a host device node made available in the container
+type Device struct {
+	Path          string // Device node on the host
+	ContainerPath string // Path of the node in the container
+	Permissions   string // Access allowed by the device cgroup, a combination of r, w and m
+}
+
+// String formats the device the way it is given on the command line
+func (d Device) String() string {
+	return d.Path + ":" + d.ContainerPath + ":" + d.Permissions
+}
+
+// HostEntry is an extra line for the container's /etc/hosts
+type HostEntry struct {
+	Name string
+	IP   string
+}
+
+// NetworkShaping degrades the container's traffic on purpose. Every setting
+// applies to each direction separately.
+type NetworkShaping struct {
+	Rate  uint64        // Bits per second, 0 for unlimited
+	Delay time.Duration // Added latency
+	Loss  float64       // Percentage of packets dropped
+}
+
+// Enabled reports whether any shaping is configured
+func (s NetworkShaping) Enabled() bool {
+	return s.Rate > 0 || s.Delay > 0 || s.Loss > 0
+}
+
+// String formats the settings the way they are given on the command line
+func (s NetworkShaping) String() string {
+	if !s.Enabled() {
+		return "none"
+	}
+
+	var parts []string
+	if s.Rate > 0 {
+		parts = append(parts, "rate "+formatRate(s.Rate))
+	}
+	if s.Delay > 0 {
+		parts = append(parts, "delay "+s.Delay.String())
+	}
+	if s.Loss > 0 {
+		parts = append(parts, "loss "+strconv.FormatFloat(s.Loss, 'f', -1, 64)+"%")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// EgressRule allows a container with DenyEgress to reach a destination
+type EgressRule struct {
+	Host     string   // Address, CIDR or hostname, "*" for any destination
+	Port     int      // 0 for any port
+	Protocol string   // tcp or udp, empty for both
+	Addrs    []string // Host resolved to addresses when the container starts
+}
+
+// String formats the rule the way it is given on the command line
+func (r EgressRule) String() string {
+	s := r.Host
+	if r.Port != 0 {
+		if strings.Contains(r.Host, ":") {
+			s = "[" + r.Host + "]"
+		}
+		s += ":" + strconv.Itoa(r.Port)
+	}
+	if r.Protocol != "" {
+		s += "/" + r.Protocol
+	}
+	return s
+}
+
+// PortMapping publishes a container port on the host
+type PortMapping struct {
+	HostIP        string // Host address to listen on, empty for all addresses
+	HostPort      int
+	ContainerPort int
+	Protocol      string // tcp or udp
+}
+
+// String formats the mapping the way it is given on the command line
+func (p PortMapping) String() string {
+	host := strconv.Itoa(p.HostPort)
+	if p.HostIP != "" {
+		host = net.JoinHostPort(p.HostIP, host)
+	}
+	return fmt.Sprintf("%s:%d/%s", host, p.ContainerPort, p.Protocol)
 }
 
 // NewDefaultConfig returns a configuration with sensible defaults
 func NewDefaultConfig() *ContainerConfig {
 	return &ContainerConfig{
+		ID:           generateID(),
 		Hostname:     "container",
 		RootFS:       "./namespace_fs",
-		NetworkCIDR:  "192.168.1.0/24",
-		HostIP:       "192.168.1.1",
-		ContainerIP:  "192.168.1.2",
+		Network:      defaultNetwork, // Subnet, bridge and gateway are resolved at startup
+		ContainerIP:  "",             // Allocated from the network at startup
 		Mounts:       []Mount{},
+		ShmSize:      defaultShmSize,
 	}
 }
 
@@ -43,40 +250,81 @@ func ParseFlags(args []string) (*ContainerConfig, error) {
 	
 	flagSet := flag.NewFlagSet("container", flag.ExitOnError)
 	
+	name := flagSet.String("name", config.Name, "Container name, resolvable by other containers on networks with embedded DNS")
 	hostname := flagSet.String("hostname", config.Hostname, "Container hostname")
 	rootfs := flagSet.String("rootfs", config.RootFS, "Container root filesystem path")
-	networkCIDR := flagSet.String("network", config.NetworkCIDR, "Container network CIDR")
-	hostIP := flagSet.String("host-ip", config.HostIP, "Host IP address")
-	containerIP := flagSet.String("container-ip", config.ContainerIP, "Container IP address")
+	network := flagSet.String("network", config.Network, "Name of the network to attach the container to")
+	containerIP := flagSet.String("container-ip", config.ContainerIP, "Container IP address (default: next free address in the network)")
+	containerIPv6 := flagSet.String("ipv6", config.ContainerIPv6, "Container IPv6 address on a dual-stack network (default: next free address)")
+	egressIface := flagSet.String("egress-iface", config.EgressIface, "Host interface for outbound traffic (default: interface of the default route)")
 	
 	var mountFlags multiString
-	flagSet.Var(&mountFlags, "mount", "Bind mount (format: host_path:container_path[:ro]). Can be specified multiple times")
-	
-	// Parse everything except the command
-	var commandStart int
-	for i, arg := range args {
-		if !strings.HasPrefix(arg, "-") {
-			commandStart = i
-			break
-		}
-	}
+	flagSet.Var(&mountFlags, "mount", "Mount (format: type=bind|tmpfs|volume,source=...,target=...[,readonly][,...] or host_path:container_path[:options]). Can be specified multiple times")
+	flagSet.Var(&mountFlags, "v", "Same as --mount")
+	flagSet.Var(&mountFlags, "volume", "Same as --mount")
+
+	var tmpfsFlags multiString
+	flagSet.Var(&tmpfsFlags, "tmpfs", "Mount a tmpfs (format: container_path[:options], options such as size=64m,mode=1777,noexec). Can be specified multiple times")
+	storageSize := flagSet.String("storage-size", "", "Limit the container's writes to a layer of this size over the rootfs, e.g. 10g")
+	readOnly := flagSet.Bool("read-only", false, "Mount the root filesystem read-only, keeping /tmp, /run, /var/tmp and --tmpfs paths writable")
+
+	var deviceFlags multiString
+	flagSet.Var(&deviceFlags, "device", "Pass a host device to the container (format: host_path[:container_path][:rwm]). Can be specified multiple times")
+	writableSys := flagSet.Bool("writable-sys", false, "Mount /sys and /sys/fs/cgroup read-write, e.g. for nested containers")
+	shmSize := flagSet.String("shm-size", "64m", "Size of /dev/shm, e.g. 128m or 1g")
+
+	var dnsFlags, dnsSearchFlags, dnsOptionFlags multiString
+	flagSet.Var(&dnsFlags, "dns", "Nameserver for the container, replaces the host's. Can be specified multiple times")
+	flagSet.Var(&dnsSearchFlags, "dns-search", "DNS search domain, replaces the host's. Can be specified multiple times")
+	flagSet.Var(&dnsOptionFlags, "dns-option", "resolv.conf option such as ndots:2, replaces the host's. Can be specified multiple times")
+
+	rate := flagSet.String("network-rate", "", "Limit bandwidth in each direction, e.g. 10mbit or 500kbit")
+	delay := flagSet.String("network-delay", "", "Add latency in each direction, e.g. 100ms")
+	loss := flagSet.String("network-loss", "", "Drop a percentage of packets in each direction, e.g. 1%")
+
+	var aliasFlags multiString
+	flagSet.Var(&aliasFlags, "network-alias", "Extra name for the container on its network. Can be specified multiple times")
+
+	denyEgress := flagSet.Bool("deny-egress", false, "Drop outbound traffic except to destinations allowed with --allow-egress")
+	var allowEgressFlags multiString
+	flagSet.Var(&allowEgressFlags, "allow-egress", "Allowed destination (format: host|ip|cidr[:port][/proto]), implies --deny-egress. Can be specified multiple times")
+
+	var addHostFlags multiString
+	flagSet.Var(&addHostFlags, "add-host", "Add an entry to /etc/hosts (format: name:ip). Can be specified multiple times")
+
+	var portFlags multiString
+	flagSet.Var(&portFlags, "p", "Publish a container port (format: [host_ip:]host_port:container_port[/proto]). Can be specified multiple times")
+	flagSet.Var(&portFlags, "publish", "Same as -p")
 	
-	if commandStart == 0 {
-		config.Command = args
-	} else {
-		err := flagSet.Parse(args[:commandStart])
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse flags: %v", err)
-		}
-		config.Command = args[commandStart:]
+	// Parse flags up to the first non-flag argument, which starts the command
+	if err := flagSet.Parse(args); err != nil {
+		return nil, fmt.Errorf("failed to parse flags: %v", err)
 	}
+	config.Command = flagSet.Args()
 	
 	// Update config with parsed values
+	config.Name = *name
 	config.Hostname = *hostname
 	config.RootFS = *rootfs
-	config.NetworkCIDR = *networkCIDR
-	config.HostIP = *hostIP
+	config.Network = *network
 	config.ContainerIP = *containerIP
+	config.ContainerIPv6 = *containerIPv6
+	config.EgressIface = *egressIface
+	config.WritableSys = *writableSys
+	config.ReadOnly = *readOnly
+	config.DNSSearch = dnsSearchFlags
+	config.DNSOptions = dnsOptionFlags
+
+	for _, ns := range dnsFlags {
+		if net.ParseIP(ns) == nil {
+			return nil, fmt.Errorf("invalid DNS server %q", ns)
+		}
+		config.DNS = append(config.DNS, ns)
+	}
+
+	if _, shared := sharedNetworkContainer(config.Network); !shared && !isNetworkName(config.Network) {
+		return nil, fmt.Errorf("--network takes a network name, create one with 'network create --subnet %s NAME'", config.Network)
+	}
 	
 	// Parse mount options
 	for _, mountStr := range mountFlags {
@@ -87,11 +335,89 @@ func ParseFlags(args []string) (*ContainerConfig, error) {
 		config.Mounts = append(config.Mounts, mount)
 	}
 	
+	// Parse devices
+	for _, deviceStr := range deviceFlags {
+		device, err := parseDevice(deviceStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device '%s': %v", deviceStr, err)
+		}
+		config.Devices = append(config.Devices, device)
+	}
+
+	size, err := parseSize(*shmSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --shm-size: %v", err)
+	}
+	config.ShmSize = size
+
+	if *storageSize != "" {
+		if config.StorageSize, err = parseSize(*storageSize); err != nil {
+			return nil, fmt.Errorf("invalid --storage-size: %v", err)
+		}
+		if config.StorageSize < minVolumeSize {
+			return nil, fmt.Errorf("--storage-size must be at least %s", formatBytes(minVolumeSize))
+		}
+	}
+
+	for _, containerName := range append([]string{config.Name}, aliasFlags...) {
+		if containerName != "" && !validContainerName.MatchString(containerName) {
+			return nil, fmt.Errorf("invalid container name or alias %q", containerName)
+		}
+	}
+	config.NetworkAliases = aliasFlags
+	if len(config.NetworkAliases) > 0 && !usesBridge(config) {
+		return nil, fmt.Errorf("--network-alias requires a bridge network, not %s", config.Network)
+	}
+
+	// Parse traffic shaping
+	if err := config.Shaping.Set(*rate, *delay, *loss); err != nil {
+		return nil, err
+	}
+	if config.Shaping.Enabled() && !usesBridge(config) {
+		return nil, fmt.Errorf("network shaping requires a bridge network, not %s", config.Network)
+	}
+
+	// Parse the egress policy
+	for _, ruleStr := range allowEgressFlags {
+		rule, err := parseEgressRule(ruleStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress rule '%s': %v", ruleStr, err)
+		}
+		config.AllowEgress = append(config.AllowEgress, rule)
+	}
+	config.DenyEgress = *denyEgress || len(config.AllowEgress) > 0
+	if config.DenyEgress && !usesBridge(config) {
+		return nil, fmt.Errorf("--deny-egress and --allow-egress require a bridge network, not %s", config.Network)
+	}
+
+	// Parse extra /etc/hosts entries
+	for _, hostStr := range addHostFlags {
+		entry, err := parseHostEntry(hostStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host entry '%s': %v", hostStr, err)
+		}
+		config.ExtraHosts = append(config.ExtraHosts, entry)
+	}
+
+	// Parse published ports
+	for _, portStr := range portFlags {
+		port, err := parsePortMapping(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port specification '%s': %v", portStr, err)
+		}
+		config.Ports = append(config.Ports, port)
+	}
+
+	if !usesBridge(config) && (config.ContainerIP != "" || config.ContainerIPv6 != "" || len(config.Ports) > 0) {
+		return nil, fmt.Errorf("--container-ip, --ipv6 and --publish require a bridge network, not %s", config.Network)
+	}
+	
 	// Add default /app mount if none specified
 	if len(config.Mounts) == 0 {
 		cwd, err := os.Getwd()
 		if err == nil {
 			config.Mounts = append(config.Mounts, Mount{
+				Type:        mountBind,
 				Source:      cwd,
 				Destination: "/app",
 				ReadOnly:    false,
@@ -99,6 +425,24 @@ func ParseFlags(args []string) (*ContainerConfig, error) {
 		}
 	}
 	
+	// Parse tmpfs mounts, they don't replace the default /app mount
+	for _, tmpfsStr := range tmpfsFlags {
+		mount, err := parseTmpfs(tmpfsStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tmpfs specification '%s': %v", tmpfsStr, err)
+		}
+		config.Mounts = append(config.Mounts, mount)
+	}
+
+	// Writable scratch space for a read-only rootfs
+	if config.ReadOnly {
+		for _, path := range readOnlyTmpfsPaths {
+			if !hasMountAt(config.Mounts, path) {
+				config.Mounts = append(config.Mounts, Mount{Type: mountTmpfs, Destination: path, Options: []string{"nosuid", "nodev"}})
+			}
+		}
+	}
+
 	if len(config.Command) == 0 {
 		return nil, fmt.Errorf("no command specified")
 	}
@@ -106,26 +450,541 @@ func ParseFlags(args []string) (*ContainerConfig, error) {
 	return config, nil
 }
 
-// parseMount parses a mount string in the format "host_path:container_path[:ro]"
+// parseDevice parses a device in the format
+// "host_path[:container_path][:permissions]", where permissions is a
+// combination of r (read), w (write) and m (mknod)
+func parseDevice(deviceStr string) (Device, error) {
+	parts := strings.Split(deviceStr, ":")
+	if len(parts) > 3 {
+		return Device{}, fmt.Errorf("device format should be host_path[:container_path][:rwm]")
+	}
+
+	device := Device{Path: parts[0], ContainerPath: parts[0], Permissions: "rwm"}
+	switch {
+	case len(parts) == 3:
+		device.ContainerPath, device.Permissions = parts[1], parts[2]
+	case len(parts) == 2 && validDevicePermissions(parts[1]):
+		device.Permissions = parts[1]
+	case len(parts) == 2:
+		device.ContainerPath = parts[1]
+	}
+
+	if !filepath.IsAbs(device.Path) || !filepath.IsAbs(device.ContainerPath) {
+		return Device{}, fmt.Errorf("device paths must be absolute")
+	}
+	if !validDevicePermissions(device.Permissions) {
+		return Device{}, fmt.Errorf("invalid permissions %q, use a combination of r, w and m", device.Permissions)
+	}
+
+	info, err := os.Stat(device.Path)
+	if err != nil {
+		return Device{}, err
+	}
+	if info.Mode()&os.ModeDevice == 0 {
+		return Device{}, fmt.Errorf("%s is not a device", device.Path)
+	}
+
+	return device, nil
+}
+
+// validDevicePermissions reports whether perms is a combination of r, w and m
+func validDevicePermissions(perms string) bool {
+	if perms == "" {
+		return false
+	}
+	for _, c := range perms {
+		if !strings.ContainsRune("rwm", c) || strings.Count(perms, string(c)) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// mountFieldKeys are the keys parseMountFields understands
+var mountFieldKeys = map[string]bool{
+	"type": true, "source": true, "src": true, "target": true, "destination": true, "dst": true,
+	"readonly": true, "ro": true, "bind-propagation": true, "bind-recursive": true,
+	"bind-nonrecursive": true, "tmpfs-size": true, "tmpfs-mode": true, "options": true, "o": true,
+	"idmap": true,
+}
+
+// parseMount parses a mount given to --mount or -v, either in the key/value
+// syntax or as the "host_path:container_path[:options]" shorthand. Only a
+// first field starting with a known key picks the key/value syntax, so host
+// paths containing "=" still work as shorthand.
 func parseMount(mountStr string) (Mount, error) {
+	var mount Mount
+	var err error
+	first := strings.TrimPrefix(strings.SplitN(mountStr, ",", 2)[0], "\"")
+	if key, _, _ := strings.Cut(first, "="); mountFieldKeys[strings.ToLower(key)] {
+		mount, err = parseMountFields(mountStr)
+	} else {
+		mount, err = parseMountShorthand(mountStr)
+	}
+	if err != nil {
+		return Mount{}, err
+	}
+
+	if err := validateMount(&mount); err != nil {
+		return Mount{}, err
+	}
+	return mount, nil
+}
+
+// parseTmpfs parses a tmpfs given to --tmpfs in the format
+// "container_path[:options]", where options is a comma separated list such as
+// size=64m,mode=1770,noexec
+func parseTmpfs(tmpfsStr string) (Mount, error) {
+	parts := strings.SplitN(tmpfsStr, ":", 2)
+	mount := Mount{Type: mountTmpfs, Destination: parts[0]}
+	if len(parts) == 2 {
+		for _, opt := range strings.Split(parts[1], ",") {
+			switch {
+			case opt == "ro":
+				mount.ReadOnly = true
+			case opt == "rw":
+				mount.ReadOnly = false
+			case strings.HasPrefix(opt, "size="):
+				mount.TmpfsSize = strings.TrimPrefix(opt, "size=")
+			case strings.HasPrefix(opt, "mode="):
+				mode, err := strconv.ParseUint(strings.TrimPrefix(opt, "mode="), 8, 32)
+				if err != nil || mode > 07777 {
+					return Mount{}, fmt.Errorf("mode must be octal permissions such as 1770, not %q", opt)
+				}
+				mount.TmpfsMode = os.FileMode(mode)
+			default:
+				mount.Options = append(mount.Options, opt)
+			}
+		}
+	}
+
+	if err := validateMount(&mount); err != nil {
+		return Mount{}, err
+	}
+	return mount, nil
+}
+
+// hasMountAt reports whether one of the mounts is mounted at dest
+func hasMountAt(mounts []Mount, dest string) bool {
+	for _, mount := range mounts {
+		if filepath.Clean(mount.Destination) == dest {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMountShorthand parses a bind mount in the format
+// "host_path:container_path[:options]", where options is a comma separated
+// list such as ro,nosuid,rslave
+func parseMountShorthand(mountStr string) (Mount, error) {
 	parts := strings.Split(mountStr, ":")
 	if len(parts) < 2 || len(parts) > 3 {
-		return Mount{}, fmt.Errorf("mount format should be host_path:container_path[:ro]")
+		return Mount{}, fmt.Errorf("mount format should be host_path:container_path[:options], " +
+			"use type=bind,source=PATH,target=PATH for paths containing colons")
 	}
-	
-	mount := Mount{
-		Source:      parts[0],
-		Destination: parts[1],
-		ReadOnly:    false,
+
+	mount := Mount{Type: mountBind, Source: parts[0], Destination: parts[1]}
+	if len(parts) == 2 {
+		return mount, nil
 	}
-	
-	if len(parts) == 3 && parts[2] == "ro" {
-		mount.ReadOnly = true
+
+	for _, opt := range strings.Split(parts[2], ",") {
+		switch {
+		case opt == "ro":
+			mount.ReadOnly = true
+		case opt == "rw":
+			mount.ReadOnly = false
+		case opt == "rbind":
+			mount.NonRecursive = false
+		case opt == "bind":
+			mount.NonRecursive = true
+		case contains(mountPropagations, opt):
+			mount.Propagation = opt
+		default:
+			mount.Options = append(mount.Options, opt)
+		}
 	}
-	
 	return mount, nil
 }
 
+// parseMountFields parses the key/value syntax, such as
+// "type=bind,source=/data,target=/data,readonly". The fields are CSV, so a
+// source containing commas can be quoted. Flags following options= may be
+// given as fields of their own, as in "options=nosuid,nodev".
+func parseMountFields(mountStr string) (Mount, error) {
+	fields, err := csv.NewReader(strings.NewReader(mountStr)).Read()
+	if err != nil {
+		return Mount{}, fmt.Errorf("invalid mount fields: %v", err)
+	}
+
+	mount := Mount{Type: mountBind}
+	for _, field := range fields {
+		key, value, hasValue := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "type":
+			mount.Type = value
+		case "source", "src":
+			mount.Source = value
+		case "target", "destination", "dst":
+			mount.Destination = value
+		case "readonly", "ro":
+			if mount.ReadOnly, err = parseMountBool(key, value, hasValue); err != nil {
+				return Mount{}, err
+			}
+		case "bind-propagation":
+			mount.Propagation = value
+		case "bind-recursive":
+			switch value {
+			case "enabled":
+				mount.NonRecursive = false
+			case "disabled":
+				mount.NonRecursive = true
+			default:
+				return Mount{}, fmt.Errorf("bind-recursive must be enabled or disabled, not %q", value)
+			}
+		case "bind-nonrecursive":
+			if mount.NonRecursive, err = parseMountBool(key, value, hasValue); err != nil {
+				return Mount{}, err
+			}
+		case "tmpfs-size":
+			mount.TmpfsSize = value
+		case "tmpfs-mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 07777 {
+				return Mount{}, fmt.Errorf("tmpfs-mode must be octal permissions such as 1770, not %q", value)
+			}
+			mount.TmpfsMode = os.FileMode(mode)
+		case "options", "o":
+			mount.Options = append(mount.Options, strings.Split(value, ",")...)
+		case "idmap":
+			mapping, err := parseIDMapping(value)
+			if err != nil {
+				return Mount{}, err
+			}
+			mount.IDMap = append(mount.IDMap, mapping)
+		default:
+			if hasValue {
+				return Mount{}, fmt.Errorf("unknown mount field %q", key)
+			}
+			mount.Options = append(mount.Options, field)
+		}
+	}
+
+	return mount, nil
+}
+
+// parseIDMapping parses an idmap= range in the format
+// "container_id:host_id:count", applied to both user and group IDs
+func parseIDMapping(value string) (IDMapping, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return IDMapping{}, fmt.Errorf("idmap format should be container_id:host_id:count, not %q", value)
+	}
+
+	var ids [3]uint32
+	for i, part := range parts {
+		id, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return IDMapping{}, fmt.Errorf("invalid idmap %q: %v", value, err)
+		}
+		ids[i] = uint32(id)
+	}
+
+	mapping := IDMapping{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}
+	if mapping.Size == 0 || uint64(mapping.ContainerID)+uint64(mapping.Size) > 1<<32-1 ||
+		uint64(mapping.HostID)+uint64(mapping.Size) > 1<<32-1 {
+		return IDMapping{}, fmt.Errorf("idmap %q must map at least one ID, within the 32-bit ID range", value)
+	}
+	return mapping, nil
+}
+
+// parseMountBool parses a boolean field, which may be given without a value
+func parseMountBool(key, value string, hasValue bool) (bool, error) {
+	if !hasValue {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, not %q", key, value)
+	}
+	return b, nil
+}
+
+// validTmpfsSize matches the sizes tmpfs accepts, in bytes, k, m, g or % of the RAM
+var validTmpfsSize = regexp.MustCompile(`^[0-9]+[kKmMgG%]?$`)
+
+// validateMount checks the fields of a parsed mount against its type, making
+// bind sources absolute
+func validateMount(mount *Mount) error {
+	if !filepath.IsAbs(mount.Destination) {
+		return fmt.Errorf("target must be an absolute path, not %q", mount.Destination)
+	}
+
+	switch mount.Type {
+	case mountBind:
+		if mount.Source == "" {
+			return fmt.Errorf("bind mounts need a source path")
+		}
+		source, err := filepath.Abs(mount.Source)
+		if err != nil {
+			return fmt.Errorf("invalid source path %s: %v", mount.Source, err)
+		}
+		mount.Source = source
+	case mountVolume:
+		if !validVolumeName.MatchString(mount.Source) {
+			return fmt.Errorf("volume mounts need a source volume name, not %q", mount.Source)
+		}
+	case mountTmpfs:
+		if mount.Source != "" {
+			return fmt.Errorf("tmpfs mounts have no source")
+		}
+		if mount.TmpfsSize != "" && !validTmpfsSize.MatchString(mount.TmpfsSize) {
+			return fmt.Errorf("tmpfs-size must be a size such as 64m, not %q", mount.TmpfsSize)
+		}
+	default:
+		return fmt.Errorf("unknown mount type %q, expected bind, tmpfs or volume", mount.Type)
+	}
+
+	if mount.Type != mountBind && (mount.NonRecursive || mount.Propagation != "") {
+		return fmt.Errorf("bind-recursive and bind-propagation only apply to bind mounts")
+	}
+	if mount.Type != mountTmpfs && (mount.TmpfsSize != "" || mount.TmpfsMode != 0) {
+		return fmt.Errorf("tmpfs-size and tmpfs-mode only apply to tmpfs mounts")
+	}
+	if mount.Type == mountTmpfs && len(mount.IDMap) > 0 {
+		return fmt.Errorf("idmap only applies to bind mounts and volumes")
+	}
+	if mount.Propagation != "" && !contains(mountPropagations, mount.Propagation) {
+		return fmt.Errorf("invalid bind propagation %q, expected one of %s", mount.Propagation, strings.Join(mountPropagations, ", "))
+	}
+	for _, opt := range mount.Options {
+		if _, ok := mountOptionFlags[opt]; !ok {
+			return fmt.Errorf("unknown mount option %q", opt)
+		}
+	}
+
+	return nil
+}
+
+// parseHostEntry parses a host entry in the format "name:ip". The address may
+// be IPv6, so only the first colon separates the name.
+func parseHostEntry(hostStr string) (HostEntry, error) {
+	parts := strings.SplitN(hostStr, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return HostEntry{}, fmt.Errorf("host format should be name:ip")
+	}
+
+	ip := net.ParseIP(strings.Trim(parts[1], "[]"))
+	if ip == nil {
+		return HostEntry{}, fmt.Errorf("invalid IP address: %s", parts[1])
+	}
+
+	return HostEntry{Name: parts[0], IP: ip.String()}, nil
+}
+
+// Set updates the settings given as command line values, leaving the ones
+// that are empty alone. "0" removes a setting.
+func (s *NetworkShaping) Set(rate, delay, loss string) error {
+	var err error
+	if rate != "" {
+		if s.Rate, err = parseRate(rate); err != nil {
+			return fmt.Errorf("invalid network rate '%s': %v", rate, err)
+		}
+	}
+	if delay != "" {
+		if s.Delay, err = time.ParseDuration(delay); err != nil || s.Delay < 0 {
+			return fmt.Errorf("invalid network delay '%s': use a duration such as 100ms", delay)
+		}
+	}
+	if loss != "" {
+		s.Loss, err = strconv.ParseFloat(strings.TrimSuffix(loss, "%"), 64)
+		if err != nil || s.Loss < 0 || s.Loss > 100 {
+			return fmt.Errorf("invalid network loss '%s': use a percentage between 0 and 100", loss)
+		}
+	}
+	return nil
+}
+
+// rateUnits are the tc(8) rate units, in bits per second
+var rateUnits = []struct {
+	suffix string
+	bits   uint64
+}{
+	{"tbit", 1000 * 1000 * 1000 * 1000},
+	{"gbit", 1000 * 1000 * 1000},
+	{"mbit", 1000 * 1000},
+	{"kbit", 1000},
+	{"bit", 1},
+	{"tbps", 8 * 1000 * 1000 * 1000 * 1000},
+	{"gbps", 8 * 1000 * 1000 * 1000},
+	{"mbps", 8 * 1000 * 1000},
+	{"kbps", 8 * 1000},
+	{"bps", 8},
+}
+
+// parseRate parses a rate such as "10mbit" into bits per second. Like tc,
+// "bit" units count bits and "bps" units count bytes.
+func parseRate(rateStr string) (uint64, error) {
+	if rateStr == "0" {
+		return 0, nil
+	}
+
+	lower := strings.ToLower(rateStr)
+	for _, unit := range rateUnits {
+		if !strings.HasSuffix(lower, unit.suffix) {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimSuffix(lower, unit.suffix), 64)
+		if err != nil || value <= 0 {
+			return 0, fmt.Errorf("%q is not a valid rate", rateStr)
+		}
+		return uint64(value * float64(unit.bits)), nil
+	}
+
+	return 0, fmt.Errorf("%q needs a unit such as kbit, mbit or gbit", rateStr)
+}
+
+// formatRate formats bits per second with the largest whole tc unit
+func formatRate(bits uint64) string {
+	for _, unit := range rateUnits[:5] {
+		if bits >= unit.bits && bits%unit.bits == 0 {
+			return strconv.FormatUint(bits/unit.bits, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatUint(bits, 10) + "bit"
+}
+
+// sizeUnits are the units accepted by parseSize, decimal like memory limits
+var sizeUnits = []struct {
+	suffix string
+	bytes  uint64
+}{
+	{"t", 1000 * 1000 * 1000 * 1000},
+	{"g", 1000 * 1000 * 1000},
+	{"m", 1000 * 1000},
+	{"k", 1000},
+}
+
+// parseSize parses a size such as "500m" or "10GB" into bytes
+func parseSize(sizeStr string) (uint64, error) {
+	value, multiplier := strings.TrimSuffix(strings.ToLower(sizeStr), "b"), uint64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSuffix(value, unit.suffix), unit.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a valid size", sizeStr)
+	}
+	return uint64(n * float64(multiplier)), nil
+}
+
+// parseEgressRule parses an egress rule in the format "host[:port][/proto]",
+// where host is an address, a CIDR, a hostname or "*". IPv6 addresses and
+// CIDRs need brackets when a port follows.
+func parseEgressRule(ruleStr string) (EgressRule, error) {
+	var rule EgressRule
+
+	// A slash is either the protocol or part of a CIDR
+	if i := strings.LastIndex(ruleStr, "/"); i != -1 {
+		if proto := strings.ToLower(ruleStr[i+1:]); proto == "tcp" || proto == "udp" {
+			rule.Protocol = proto
+			ruleStr = ruleStr[:i]
+		}
+	}
+
+	host, port := ruleStr, ""
+	switch {
+	case strings.HasPrefix(ruleStr, "["):
+		end := strings.Index(ruleStr, "]")
+		if end == -1 {
+			return EgressRule{}, fmt.Errorf("missing ]")
+		}
+		host, port = ruleStr[1:end], ruleStr[end+1:]
+		if port != "" && !strings.HasPrefix(port, ":") {
+			return EgressRule{}, fmt.Errorf("unexpected %q after ]", port)
+		}
+		port = strings.TrimPrefix(port, ":")
+	case strings.Count(ruleStr, ":") == 1:
+		i := strings.Index(ruleStr, ":")
+		host, port = ruleStr[:i], ruleStr[i+1:]
+	}
+
+	if port != "" {
+		var err error
+		if rule.Port, err = parsePort(port); err != nil {
+			return EgressRule{}, err
+		}
+	}
+
+	switch {
+	case host == "":
+		return EgressRule{}, fmt.Errorf("format should be host[:port][/proto], use * for any host")
+	case host == "*":
+	case strings.Contains(host, "/") || strings.Contains(host, ":"):
+		if _, _, err := parseAddrOrCIDR(host); err != nil {
+			return EgressRule{}, err
+		}
+	case net.ParseIP(host) == nil && strings.ContainsAny(host, " \t,;"):
+		return EgressRule{}, fmt.Errorf("invalid host %q", host)
+	}
+	rule.Host = host
+
+	return rule, nil
+}
+
+// parsePortMapping parses a port string in the format "[host_ip:]host_port:container_port[/proto]"
+func parsePortMapping(portStr string) (PortMapping, error) {
+	port := PortMapping{Protocol: "tcp"}
+
+	if i := strings.LastIndex(portStr, "/"); i != -1 {
+		port.Protocol = strings.ToLower(portStr[i+1:])
+		portStr = portStr[:i]
+	}
+	if port.Protocol != "tcp" && port.Protocol != "udp" {
+		return PortMapping{}, fmt.Errorf("protocol must be tcp or udp")
+	}
+
+	// Split off the container port, leaving "[host_ip:]host_port"
+	i := strings.LastIndex(portStr, ":")
+	if i == -1 {
+		return PortMapping{}, fmt.Errorf("port format should be [host_ip:]host_port:container_port[/proto]")
+	}
+	hostPart, containerPart := portStr[:i], portStr[i+1:]
+
+	if i := strings.LastIndex(hostPart, ":"); i != -1 {
+		port.HostIP = strings.Trim(hostPart[:i], "[]")
+		hostPart = hostPart[i+1:]
+		if net.ParseIP(port.HostIP) == nil {
+			return PortMapping{}, fmt.Errorf("invalid host IP: %s", port.HostIP)
+		}
+	}
+
+	var err error
+	if port.HostPort, err = parsePort(hostPart); err != nil {
+		return PortMapping{}, fmt.Errorf("invalid host port: %v", err)
+	}
+	if port.ContainerPort, err = parsePort(containerPart); err != nil {
+		return PortMapping{}, fmt.Errorf("invalid container port: %v", err)
+	}
+
+	return port, nil
+}
+
+// parsePort converts a string to a TCP/UDP port number
+func parsePort(portStr string) (int, error) {
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a valid port", portStr)
+	}
+	return port, nil
+}
+
 // multiString allows multiple values for the same flag
 type multiString []string
 
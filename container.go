@@ -7,7 +7,12 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 // RunContainer starts a new container with the given configuration
@@ -17,12 +22,51 @@ func RunContainer(config *ContainerConfig) error {
 		return fmt.Errorf("invalid configuration: %v", err)
 	}
 
+	// Names must be unique so they can be used to refer to the container
+	if config.Name != "" {
+		states, err := ListContainerStates()
+		if err != nil {
+			return err
+		}
+		if existing := containerByName(states, config.Name); existing != nil {
+			return fmt.Errorf("name %s is already used by container %s", config.Name, shortID(existing.Config.ID))
+		}
+	}
+
 	// Prepare the root filesystem
 	if err := PrepareRootFS(config.RootFS); err != nil {
 		return fmt.Errorf("failed to prepare root filesystem: %v", err)
 	}
 
-	logInfo("Starting container with command: %v", config.Command)
+	// Reserve the container's address before the child needs it
+	if err := AllocateNetwork(config); err != nil {
+		return err
+	}
+
+	// Create and mount the named volumes, so they can't be removed while in use
+	if err := AcquireVolumes(config); err != nil {
+		ReleaseVolumes(config)
+		CleanupNetwork(config)
+		return err
+	}
+
+	// Generate the files the child bind mounts into the container
+	if err := writeContainerFiles(config); err != nil {
+		RemoveContainerState(config.ID)
+		ReleaseVolumes(config)
+		CleanupNetwork(config)
+		return err
+	}
+
+	// Give the container a writable layer of its own if its size is limited
+	if err := SetupStorage(config); err != nil {
+		RemoveContainerState(config.ID)
+		ReleaseVolumes(config)
+		CleanupNetwork(config)
+		return fmt.Errorf("failed to setup storage: %v", err)
+	}
+
+	logInfo("Starting container %s with command: %v", shortID(config.ID), config.Command)
 	if len(config.Mounts) > 0 {
 		logInfo("Mounts configured: %d", len(config.Mounts))
 	}
@@ -35,11 +79,16 @@ func RunContainer(config *ContainerConfig) error {
 
 	// Set environment variables for the child process
 	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("CONTAINER_ID=%s", config.ID),
 		fmt.Sprintf("CONTAINER_HOSTNAME=%s", config.Hostname),
 		fmt.Sprintf("CONTAINER_ROOTFS=%s", config.RootFS),
+		fmt.Sprintf("CONTAINER_NETWORK=%s", config.Network),
 		fmt.Sprintf("CONTAINER_NETWORK_CIDR=%s", config.NetworkCIDR),
 		fmt.Sprintf("CONTAINER_HOST_IP=%s", config.HostIP),
 		fmt.Sprintf("CONTAINER_CONTAINER_IP=%s", config.ContainerIP),
+		fmt.Sprintf("CONTAINER_IPV6_CIDR=%s", config.IPv6CIDR),
+		fmt.Sprintf("CONTAINER_IPV6_GATEWAY=%s", config.IPv6Gateway),
+		fmt.Sprintf("CONTAINER_CONTAINER_IPV6=%s", config.ContainerIPv6),
 	)
 
 	// Add mount information to environment
@@ -49,24 +98,81 @@ func RunContainer(config *ContainerConfig) error {
 			readonly = "true"
 		}
 		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("CONTAINER_MOUNT_%d_TYPE=%s", i, mount.mountType()),
 			fmt.Sprintf("CONTAINER_MOUNT_%d_SOURCE=%s", i, mount.Source),
 			fmt.Sprintf("CONTAINER_MOUNT_%d_DEST=%s", i, mount.Destination),
 			fmt.Sprintf("CONTAINER_MOUNT_%d_READONLY=%s", i, readonly),
+			fmt.Sprintf("CONTAINER_MOUNT_%d_NONRECURSIVE=%t", i, mount.NonRecursive),
+			fmt.Sprintf("CONTAINER_MOUNT_%d_PROPAGATION=%s", i, mount.Propagation),
+			fmt.Sprintf("CONTAINER_MOUNT_%d_TMPFS_SIZE=%s", i, mount.TmpfsSize),
+			fmt.Sprintf("CONTAINER_MOUNT_%d_TMPFS_MODE=%o", i, mount.TmpfsMode),
+			fmt.Sprintf("CONTAINER_MOUNT_%d_OPTIONS=%s", i, strings.Join(mount.Options, ",")),
 		)
+
+		// Idmapped binds get their user namespace as an extra file
+		if len(mount.IDMap) > 0 {
+			userns, err := newIDMapUserns(mount.IDMap)
+			if err != nil {
+				for _, f := range cmd.ExtraFiles {
+					f.Close()
+				}
+				CleanupStorage(config)
+				RemoveContainerState(config.ID)
+				ReleaseVolumes(config)
+				CleanupNetwork(config)
+				return fmt.Errorf("mount %s: %v", mount.Destination, err)
+			}
+			cmd.ExtraFiles = append(cmd.ExtraFiles, userns)
+
+			var mappings []string
+			for _, mapping := range mount.IDMap {
+				mappings = append(mappings, mapping.String())
+			}
+			cmd.Env = append(cmd.Env,
+				fmt.Sprintf("CONTAINER_MOUNT_%d_IDMAP=%s", i, strings.Join(mappings, ",")),
+				fmt.Sprintf("CONTAINER_MOUNT_%d_USERNS_FD=%d", i, 2+len(cmd.ExtraFiles)), // Extra files start at fd 3
+			)
+		}
 	}
 	cmd.Env = append(cmd.Env, fmt.Sprintf("CONTAINER_MOUNT_COUNT=%d", len(config.Mounts)))
 
+	// Add device information to environment
+	for i, device := range config.Devices {
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("CONTAINER_DEVICE_%d_PATH=%s", i, device.Path),
+			fmt.Sprintf("CONTAINER_DEVICE_%d_CONTAINER_PATH=%s", i, device.ContainerPath),
+			fmt.Sprintf("CONTAINER_DEVICE_%d_PERMISSIONS=%s", i, device.Permissions),
+		)
+	}
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("CONTAINER_DEVICE_COUNT=%d", len(config.Devices)),
+		fmt.Sprintf("CONTAINER_SHM_SIZE=%d", config.ShmSize),
+		fmt.Sprintf("CONTAINER_WRITABLE_SYS=%t", config.WritableSys),
+		fmt.Sprintf("CONTAINER_READ_ONLY=%t", config.ReadOnly),
+		fmt.Sprintf("CONTAINER_STORAGE_SIZE=%d", config.StorageSize),
+	)
+
 	// Configure namespaces for the child process
+	cloneflags := uintptr(syscall.CLONE_NEWUTS | // UTS namespace (hostname)
+		syscall.CLONE_NEWPID | // PID namespace
+		syscall.CLONE_NEWNS) // Mount namespace
+	if needsNetworkNamespace(config) {
+		cloneflags |= syscall.CLONE_NEWNET // Network namespace
+	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | // UTS namespace (hostname)
-			syscall.CLONE_NEWPID | // PID namespace
-			syscall.CLONE_NEWNS | // Mount namespace
-			syscall.CLONE_NEWNET, // Network namespace
-		Unshareflags: syscall.CLONE_NEWNS, // Unshare mount namespace
+		Cloneflags: cloneflags,
 	}
 
 	// Start the container process
-	if err := cmd.Start(); err != nil {
+	err := StartInNetwork(cmd, config)
+	for _, f := range cmd.ExtraFiles {
+		f.Close() // The child has its own copies
+	}
+	if err != nil {
+		CleanupStorage(config)
+		RemoveContainerState(config.ID)
+		ReleaseVolumes(config)
+		CleanupNetwork(config)
 		return fmt.Errorf("failed to start container: %v", err)
 	}
 
@@ -76,21 +182,66 @@ func RunContainer(config *ContainerConfig) error {
 	if err := SetupNetworking(cmd.Process.Pid, config); err != nil {
 		// Kill the container process if networking setup fails
 		cmd.Process.Kill()
+		cmd.Wait()
+		CleanupStorage(config)
+		RemoveContainerState(config.ID)
+		removeContainerCgroup(config.ID)
+		ReleaseVolumes(config)
+		CleanupNetwork(config)
 		return fmt.Errorf("failed to setup networking: %v", err)
 	}
 
 	logInfo("Network setup completed")
 
+	// Resolve container names on networks with embedded DNS
+	if config.EmbeddedDNS != "" {
+		if err := EnsureDNSServer(config.Network); err != nil {
+			logError("Failed to start the DNS server of network %s: %v", config.Network, err)
+		}
+	}
+
+	// Record the container so other commands can find it
+	if err := SaveContainerState(config, cmd.Process.Pid); err != nil {
+		logError("Failed to save container state: %v", err)
+	}
+
+	// Let the other containers on the network resolve this one
+	if err := RefreshNetworkHosts(config); err != nil {
+		logError("Failed to update /etc/hosts of other containers: %v", err)
+	}
+
 	// Wait for the container to finish
-	err := cmd.Wait()
+	err = cmd.Wait()
+
+	// Discard the writable layer, the rootfs below it is untouched
+	CleanupStorage(config)
 
 	// Clean up network rules
+	RemoveContainerState(config.ID)
+	if err := RefreshNetworkHosts(config); err != nil {
+		logError("Failed to update /etc/hosts of other containers: %v", err)
+	}
+	removeContainerCgroup(config.ID)
+	ReleaseVolumes(config)
 	CleanupNetwork(config)
 	logInfo("Container finished")
 
 	return err
 }
 
+// writeContainerFiles generates the container's resolv.conf, hosts and hostname
+func writeContainerFiles(config *ContainerConfig) error {
+	if err := WriteResolvConf(config); err != nil {
+		return fmt.Errorf("failed to setup DNS: %v", err)
+	}
+
+	if err := WriteHostsFiles(config); err != nil {
+		return fmt.Errorf("failed to setup /etc/hosts: %v", err)
+	}
+
+	return nil
+}
+
 // RunChildProcess runs inside the container namespace
 func RunChildProcess(command []string) error {
 	// Parse configuration from environment variables
@@ -102,12 +253,25 @@ func RunChildProcess(command []string) error {
 	logDebug("Child process starting with config: hostname=%s, rootfs=%s",
 		config.Hostname, config.RootFS)
 
-	// Setup cgroups
+	// Setup cgroups, each container gets its own below the runtime's
 	cgroupConfig := NewDefaultCgroupConfig()
+	cgroupConfig.Name = containerCgroupName(config.ID)
+	if cgroupConfig.Devices, err = DeviceRules(config); err != nil {
+		return err
+	}
 	if err := SetupCgroups(cgroupConfig); err != nil {
 		return fmt.Errorf("failed to setup cgroups: %v", err)
 	}
 
+	// Enter a cgroup namespace only now, so its root is the container's own
+	// cgroup rather than the runtime's. Namespaces belong to threads, the
+	// command is started from this one.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+		return fmt.Errorf("failed to create cgroup namespace: %v", err)
+	}
+
 	// Setup filesystem (including mounts)
 	if err := SetupFilesystem(config); err != nil {
 		return fmt.Errorf("failed to setup filesystem: %v", err)
@@ -149,8 +313,11 @@ func validateConfig(config *ContainerConfig) error {
 	}
 
 	for i, mount := range config.Mounts {
-		if err := validatePath(mount.Source); err != nil {
-			return fmt.Errorf("invalid mount source path for mount %d: %v", i, err)
+		// Volumes are created on demand and tmpfs mounts have no source
+		if mount.mountType() == mountBind {
+			if err := validatePath(mount.Source); err != nil {
+				return fmt.Errorf("invalid mount source path for mount %d: %v", i, err)
+			}
 		}
 
 		if mount.Destination == "" {
@@ -164,11 +331,17 @@ func validateConfig(config *ContainerConfig) error {
 // configFromEnv reconstructs container configuration from environment variables
 func configFromEnv() (*ContainerConfig, error) {
 	config := &ContainerConfig{
+		ID:          os.Getenv("CONTAINER_ID"),
 		Hostname:    os.Getenv("CONTAINER_HOSTNAME"),
 		RootFS:      os.Getenv("CONTAINER_ROOTFS"),
+		Network:     os.Getenv("CONTAINER_NETWORK"),
 		NetworkCIDR: os.Getenv("CONTAINER_NETWORK_CIDR"),
 		HostIP:      os.Getenv("CONTAINER_HOST_IP"),
 		ContainerIP: os.Getenv("CONTAINER_CONTAINER_IP"),
+
+		IPv6CIDR:      os.Getenv("CONTAINER_IPV6_CIDR"),
+		IPv6Gateway:   os.Getenv("CONTAINER_IPV6_GATEWAY"),
+		ContainerIPv6: os.Getenv("CONTAINER_CONTAINER_IPV6"),
 	}
 
 	// Parse mount information
@@ -183,16 +356,70 @@ func configFromEnv() (*ContainerConfig, error) {
 			source := os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_SOURCE", i))
 			dest := os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_DEST", i))
 			readonlyStr := os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_READONLY", i))
+			tmpfsMode, err := strconv.ParseUint(os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_TMPFS_MODE", i)), 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tmpfs mode of mount %d: %v", i, err)
+			}
 
 			mount := Mount{
-				Source:      source,
-				Destination: dest,
-				ReadOnly:    readonlyStr == "true",
+				Type:         os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_TYPE", i)),
+				Source:       source,
+				Destination:  dest,
+				ReadOnly:     readonlyStr == "true",
+				NonRecursive: os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_NONRECURSIVE", i)) == "true",
+				Propagation:  os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_PROPAGATION", i)),
+				TmpfsSize:    os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_TMPFS_SIZE", i)),
+				TmpfsMode:    os.FileMode(tmpfsMode),
+			}
+			if options := os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_OPTIONS", i)); options != "" {
+				mount.Options = strings.Split(options, ",")
+			}
+			if idmap := os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_IDMAP", i)); idmap != "" {
+				for _, value := range strings.Split(idmap, ",") {
+					mapping, err := parseIDMapping(value)
+					if err != nil {
+						return nil, err
+					}
+					mount.IDMap = append(mount.IDMap, mapping)
+				}
+				if mount.usernsFd, err = strconv.Atoi(os.Getenv(fmt.Sprintf("CONTAINER_MOUNT_%d_USERNS_FD", i))); err != nil {
+					return nil, fmt.Errorf("invalid user namespace of mount %d: %v", i, err)
+				}
 			}
 
 			config.Mounts = append(config.Mounts, mount)
 		}
 	}
 
+	// Parse device information
+	if deviceCountStr := os.Getenv("CONTAINER_DEVICE_COUNT"); deviceCountStr != "" {
+		deviceCount, err := strconv.Atoi(deviceCountStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device count: %v", err)
+		}
+
+		for i := 0; i < deviceCount; i++ {
+			config.Devices = append(config.Devices, Device{
+				Path:          os.Getenv(fmt.Sprintf("CONTAINER_DEVICE_%d_PATH", i)),
+				ContainerPath: os.Getenv(fmt.Sprintf("CONTAINER_DEVICE_%d_CONTAINER_PATH", i)),
+				Permissions:   os.Getenv(fmt.Sprintf("CONTAINER_DEVICE_%d_PERMISSIONS", i)),
+			})
+		}
+	}
+
+	shmSize, err := strconv.ParseUint(os.Getenv("CONTAINER_SHM_SIZE"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid /dev/shm size: %v", err)
+	}
+	config.ShmSize = shmSize
+	config.WritableSys = os.Getenv("CONTAINER_WRITABLE_SYS") == "true"
+	config.ReadOnly = os.Getenv("CONTAINER_READ_ONLY") == "true"
+
+	storageSize, err := strconv.ParseUint(os.Getenv("CONTAINER_STORAGE_SIZE"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage size: %v", err)
+	}
+	config.StorageSize = storageSize
+
 	return config, nil
 }
@@ -0,0 +1,393 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Kinds of changes listed by diff
+const (
+	changeAdded   = 'A'
+	changeChanged = 'C'
+	changeDeleted = 'D'
+)
+
+// Change is a path a container added, changed or deleted in its rootfs
+type Change struct {
+	Kind byte
+	Path string
+}
+
+// String formats the change the way diff prints it, e.g. "A /etc/app.conf"
+func (c Change) String() string {
+	return fmt.Sprintf("%c %s", c.Kind, c.Path)
+}
+
+// containerRoot returns the container's root as seen from the host. It goes
+// through the /proc entry of the container's init, so the container's own
+// mounts, such as tmpfs and bind mounts, are seen the way it sees them.
+func containerRoot(state *ContainerState) string {
+	return fmt.Sprintf("/proc/%d/root", state.PID)
+}
+
+// copyLocation is one side of cp: a path in a container or on the host
+type copyLocation struct {
+	root string // Root of the container the path is in, empty on the host
+	path string // Absolute path, or - for a tar stream on stdin or stdout
+}
+
+// parseCopyLocation parses a cp argument, either CONTAINER:PATH or a host
+// path. Host paths containing a colon need a / or . in front of them.
+func parseCopyLocation(arg string) (copyLocation, error) {
+	ref, path := "", arg
+	if i := strings.Index(arg, ":"); i > 0 && !strings.HasPrefix(arg, "/") && !strings.HasPrefix(arg, ".") {
+		ref, path = arg[:i], arg[i+1:]
+	}
+
+	if ref == "" {
+		if path == "-" {
+			return copyLocation{path: path}, nil
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return copyLocation{}, err
+		}
+		return copyLocation{path: abs}, nil
+	}
+
+	state, err := FindContainer(ref)
+	if err != nil {
+		return copyLocation{}, err
+	}
+	return copyLocation{root: containerRoot(state), path: filepath.Join("/", path)}, nil
+}
+
+// CopyFiles copies a file or directory between a container and the host,
+// keeping ownership, permissions and times. Either side may be - for a tar
+// stream on stdin or stdout instead of a host path. The container's side
+// is handled by an fs-helper chrooted to its root.
+func CopyFiles(srcArg, destArg string) error {
+	src, err := parseCopyLocation(srcArg)
+	if err != nil {
+		return err
+	}
+	dest, err := parseCopyLocation(destArg)
+	if err != nil {
+		return err
+	}
+	if (src.root == "") == (dest.root == "") {
+		return fmt.Errorf("one of the paths must be CONTAINER:PATH and the other a host path or -")
+	}
+
+	// Tar streams name their entries after the source, like tar itself
+	srcName := filepath.Base(src.path)
+	if srcName == "/" {
+		srcName = "."
+	}
+	if dest.path == "-" {
+		return runFSHelper(src.root, nil, os.Stdout, "archive", src.path, srcName)
+	}
+	if src.path == "-" {
+		return runFSHelper(dest.root, os.Stdin, nil, "extract", dest.path)
+	}
+
+	if dest.root != "" {
+		if _, err := os.Lstat(src.path); err != nil {
+			return err
+		}
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(writeTar(writer, "/", src.path, srcName))
+		}()
+
+		err = runFSHelper(dest.root, reader, nil, "copy", dest.path)
+		reader.CloseWithError(err)
+		return err
+	}
+
+	// Copy into an existing directory, or to a new name in an existing one.
+	// The archive comes from the container, so it is extracted as if the
+	// destination directory were the root, its symlinks can't lead out.
+	destDir, destName := dest.path, srcName
+	if !isDirIn("/", dest.path) {
+		destDir, destName = filepath.Dir(dest.path), filepath.Base(dest.path)
+		if !isDirIn("/", destDir) {
+			return fmt.Errorf("destination directory %s does not exist", destDir)
+		}
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(runFSHelper(src.root, nil, writer, "archive", src.path, destName))
+	}()
+
+	err = extractTar(reader, destDir, "/", "")
+	reader.CloseWithError(err)
+	return err
+}
+
+// isDirIn reports whether path is a directory inside root
+func isDirIn(root, path string) bool {
+	resolved, err := resolveInRoot(root, path)
+	return err == nil && dirExists(resolved)
+}
+
+// runFSHelper runs an fs-helper chrooted to root with a tar stream on stdin
+// or stdout, returning what it reports on failure as the error
+func runFSHelper(root string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	cmd := exec.Command("/proc/self/exe", append([]string{"fs-helper", root}, args...)...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// FSHelper chroots to a container's root and archives or extracts files
+// there. The kernel then resolves every path inside the container, even if
+// the container swaps a directory for a symlink while it runs, which
+// resolving paths from the host can't guarantee. Commands:
+//
+//	archive PATH NAME  write PATH to stdout, its entries named after NAME
+//	extract DIR        unpack stdin into the directory DIR
+//	copy DEST          unpack stdin into the directory DEST, or as DEST
+//	manifest           write the stamps of every path to stdout as JSON
+func FSHelper(root string, args []string) error {
+	argCounts := map[string]int{"archive": 3, "extract": 2, "copy": 2, "manifest": 1}
+	if len(args) == 0 || argCounts[args[0]] != len(args) {
+		return fmt.Errorf("usage: fs-helper ROOT archive PATH NAME|extract DIR|copy DEST|manifest")
+	}
+
+	if err := syscall.Chroot(root); err != nil {
+		return fmt.Errorf("failed to chroot to %s: %v", root, err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "archive":
+		return writeTar(os.Stdout, "/", args[1], args[2])
+	case "extract":
+		if !isDirIn("/", args[1]) {
+			return fmt.Errorf("destination %s must be a directory to extract a tar stream into", args[1])
+		}
+		return extractTar(os.Stdin, "/", args[1], "")
+	case "copy":
+		dest := args[1]
+		if isDirIn("/", dest) {
+			return extractTar(os.Stdin, "/", dest, "")
+		}
+		if !isDirIn("/", filepath.Dir(dest)) {
+			return fmt.Errorf("destination directory %s does not exist", filepath.Dir(dest))
+		}
+		return extractTar(os.Stdin, "/", filepath.Dir(dest), filepath.Base(dest))
+	case "manifest":
+		manifest, err := readManifest("/")
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(os.Stdout).Encode(manifest)
+	}
+	return fmt.Errorf("unknown fs-helper command %s", args[0])
+}
+
+// ContainerDiff lists the paths a container added, changed or deleted
+// compared to its rootfs. Containers with a writable layer of their own,
+// started with --storage-size, are compared through the layer, the others
+// against the baseline of their rootfs taken when they started.
+func ContainerDiff(state *ContainerState) ([]Change, error) {
+	config := state.Config
+	if config.StorageSize == 0 {
+		return baselineDiff(state)
+	}
+
+	upper := filepath.Join(storageDir(config.ID), "upper")
+	var changes []Change
+	err := filepath.Walk(upper, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == upper {
+			return nil
+		}
+
+		rel, err := filepath.Rel(upper, file)
+		if err != nil {
+			return err
+		}
+		path := "/" + rel
+
+		// overlayfs records deletions as 0:0 character devices
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0 {
+			changes = append(changes, Change{changeDeleted, path})
+			return nil
+		}
+
+		kind := byte(changeAdded)
+		if _, err := os.Lstat(filepath.Join(config.RootFS, rel)); err == nil {
+			kind = changeChanged
+		}
+		changes = append(changes, Change{kind, path})
+
+		// The contents of a directory replaced by the container are hidden,
+		// the ones in the rootfs are gone
+		if info.IsDir() && kind == changeChanged && isOpaqueDir(file) && dirExists(filepath.Join(config.RootFS, rel)) {
+			return listDeleted(filepath.Join(config.RootFS, rel), file, path, &changes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read changes of container %s: %v", shortID(config.ID), err)
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// fileStamp identifies a version of a file. Writing to a file, changing its
+// owner or permissions and linking or renaming it all update its ctime,
+// which can't be set back.
+type fileStamp struct {
+	Ino   uint64 `json:"ino"`
+	Ctime int64  `json:"ctime"`
+}
+
+// baselineFile returns the manifest of a container's rootfs taken at start
+func baselineFile(id string) string {
+	return containerFile(id, "baseline.json")
+}
+
+// readManifest stamps every path below root, keyed by its path inside root
+func readManifest(root string) (map[string]fileStamp, error) {
+	root = strings.TrimSuffix(root, "/") + "/" // Roots under /proc are symlinks
+	manifest := make(map[string]fileStamp)
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("no inode information for %s", file)
+		}
+		manifest[filepath.Join("/", rel)] = fileStamp{Ino: st.Ino, Ctime: st.Ctim.Nano()}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// recordBaseline saves the manifest of the container's root view, before
+// anything in the container can change it. Runs in the child.
+func recordBaseline(config *ContainerConfig) error {
+	manifest, err := readManifest(fmt.Sprintf("/proc/self/fd/%d", rootView.Fd()))
+	if err != nil {
+		return fmt.Errorf("failed to record the rootfs baseline: %v", err)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(baselineFile(config.ID), data, 0600)
+}
+
+// baselineDiff compares the root view of a container writing to its rootfs
+// directly with the baseline recorded when it started. The view is read by
+// an fs-helper chrooted to it, like cp.
+func baselineDiff(state *ContainerState) ([]Change, error) {
+	data, err := ioutil.ReadFile(baselineFile(state.Config.ID))
+	if err != nil {
+		return nil, fmt.Errorf("container %s has no rootfs baseline, was it started by an older version? %v", shortID(state.Config.ID), err)
+	}
+	var baseline map[string]fileStamp
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, fmt.Errorf("invalid rootfs baseline of container %s: %v", shortID(state.Config.ID), err)
+	}
+
+	root, err := containerRootView(state)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := runFSHelper(root, nil, &out, "manifest"); err != nil {
+		return nil, fmt.Errorf("failed to read changes of container %s: %v", shortID(state.Config.ID), err)
+	}
+	var current map[string]fileStamp
+	if err := json.Unmarshal(out.Bytes(), &current); err != nil {
+		return nil, fmt.Errorf("failed to read changes of container %s: %v", shortID(state.Config.ID), err)
+	}
+
+	var changes []Change
+	for path, stamp := range current {
+		if path == "/" {
+			continue
+		}
+		if base, ok := baseline[path]; !ok {
+			changes = append(changes, Change{changeAdded, path})
+		} else if base != stamp {
+			changes = append(changes, Change{changeChanged, path})
+		}
+	}
+	for path := range baseline {
+		// A deleted directory is listed, not everything that was in it
+		_, exists := current[path]
+		_, parentExists := current[filepath.Dir(path)]
+		if !exists && parentExists {
+			changes = append(changes, Change{changeDeleted, path})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// isOpaqueDir reports whether overlayfs hides the lower directory below dir
+func isOpaqueDir(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, "trusted.overlay.opaque", buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// listDeleted records the entries of a lower directory that an opaque upper
+// directory doesn't have as deleted
+func listDeleted(lower, upper, path string, changes *[]Change) error {
+	entries, err := ioutil.ReadDir(lower)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := os.Lstat(filepath.Join(upper, entry.Name())); os.IsNotExist(err) {
+			*changes = append(*changes, Change{changeDeleted, filepath.Join(path, entry.Name())})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultShmSize is the size of /dev/shm unless --shm-size says otherwise
+const defaultShmSize = 64 * 1000 * 1000
+
+// wildcardDevice matches any major or minor number in a device rule
+const wildcardDevice = -1
+
+// deviceNode is a device node created in the container's /dev
+type deviceNode struct {
+	path         string // Path in the container
+	hostPath     string // Node to bind mount when mknod isn't permitted
+	typ          byte   // c or b
+	major, minor int64
+	mode         os.FileMode
+}
+
+// defaultDeviceNodes are created in every container
+var defaultDeviceNodes = []deviceNode{
+	{path: "/dev/null", hostPath: "/dev/null", typ: 'c', major: 1, minor: 3, mode: 0666},
+	{path: "/dev/zero", hostPath: "/dev/zero", typ: 'c', major: 1, minor: 5, mode: 0666},
+	{path: "/dev/full", hostPath: "/dev/full", typ: 'c', major: 1, minor: 7, mode: 0666},
+	{path: "/dev/random", hostPath: "/dev/random", typ: 'c', major: 1, minor: 8, mode: 0666},
+	{path: "/dev/urandom", hostPath: "/dev/urandom", typ: 'c', major: 1, minor: 9, mode: 0666},
+	{path: "/dev/tty", hostPath: "/dev/tty", typ: 'c', major: 5, minor: 0, mode: 0666},
+}
+
+// defaultDevLinks are the symlinks every container's /dev has
+var defaultDevLinks = []struct {
+	name   string
+	target string
+}{
+	{"fd", "/proc/self/fd"},
+	{"stdin", "/proc/self/fd/0"},
+	{"stdout", "/proc/self/fd/1"},
+	{"stderr", "/proc/self/fd/2"},
+	{"ptmx", "pts/ptmx"},
+}
+
+// deviceRule allows access to devices through the device cgroup
+type deviceRule struct {
+	typ          byte // c, b or a for all devices
+	major, minor int64
+	access       string // A combination of r, w and m
+}
+
+// String formats the rule the way devices.allow takes it, e.g. "c 1:3 rwm"
+func (r deviceRule) String() string {
+	number := func(n int64) string {
+		if n == wildcardDevice {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%c %s:%s %s", r.typ, number(r.major), number(r.minor), r.access)
+}
+
+// DeviceRules returns the devices the container may use: the default nodes,
+// pseudo-terminals and its --device nodes. Creating nodes is allowed so a
+// rootfs can bring its own, using them is not.
+func DeviceRules(config *ContainerConfig) ([]deviceRule, error) {
+	rules := []deviceRule{
+		{typ: 'c', major: wildcardDevice, minor: wildcardDevice, access: "m"},
+		{typ: 'b', major: wildcardDevice, minor: wildcardDevice, access: "m"},
+		{typ: 'c', major: 5, minor: 2, access: "rwm"},                // /dev/pts/ptmx
+		{typ: 'c', major: 136, minor: wildcardDevice, access: "rwm"}, // /dev/pts/*
+	}
+	for _, node := range defaultDeviceNodes {
+		rules = append(rules, deviceRule{typ: node.typ, major: node.major, minor: node.minor, access: "rwm"})
+	}
+
+	for _, device := range config.Devices {
+		node, err := hostDeviceNode(device)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, deviceRule{typ: node.typ, major: node.major, minor: node.minor, access: device.Permissions})
+	}
+
+	return rules, nil
+}
+
+// hostDeviceNode describes the host's node of a --device
+func hostDeviceNode(device Device) (deviceNode, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(device.Path, &st); err != nil {
+		return deviceNode{}, fmt.Errorf("failed to stat device %s: %v", device.Path, err)
+	}
+
+	node := deviceNode{
+		path:     device.ContainerPath,
+		hostPath: device.Path,
+		major:    int64(unix.Major(st.Rdev)),
+		minor:    int64(unix.Minor(st.Rdev)),
+		mode:     os.FileMode(st.Mode & 07777),
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		node.typ = 'c'
+	case syscall.S_IFBLK:
+		node.typ = 'b'
+	default:
+		return deviceNode{}, fmt.Errorf("%s is not a device", device.Path)
+	}
+
+	return node, nil
+}
+
+// setupDev mounts a tmpfs over the rootfs's /dev and fills it with the
+// standard device nodes, symlinks, a sized /dev/shm and the --device nodes,
+// so the container doesn't depend on what the rootfs happens to ship
+func setupDev(config *ContainerConfig) error {
+	dev := filepath.Join(config.RootFS, "dev")
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k"); err != nil {
+		return fmt.Errorf("failed to mount tmpfs on /dev: %v", err)
+	}
+
+	// devpts is mounted on /dev/pts after chroot
+	for _, dir := range []string{"pts", "shm"} {
+		if err := os.Mkdir(filepath.Join(dev, dir), 0755); err != nil {
+			return fmt.Errorf("failed to create /dev/%s: %v", dir, err)
+		}
+	}
+
+	data := fmt.Sprintf("mode=1777,size=%d", config.ShmSize)
+	if err := syscall.Mount("shm", filepath.Join(dev, "shm"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, data); err != nil {
+		return fmt.Errorf("failed to mount /dev/shm: %v", err)
+	}
+
+	for _, link := range defaultDevLinks {
+		if err := os.Symlink(link.target, filepath.Join(dev, link.name)); err != nil {
+			return fmt.Errorf("failed to create /dev/%s: %v", link.name, err)
+		}
+	}
+
+	nodes := defaultDeviceNodes
+	for _, device := range config.Devices {
+		node, err := hostDeviceNode(device)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes {
+		if err := createDeviceNode(config.RootFS, node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createDeviceNode creates a device node in the container. Without the
+// privilege to create nodes, e.g. in a user namespace, the host's node is
+// bind mounted instead.
+func createDeviceNode(rootFS string, node deviceNode) error {
+	target, err := resolveInRoot(rootFS, node.path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", node.path, err)
+	}
+	os.Remove(target)
+
+	mode := uint32(syscall.S_IFCHR)
+	if node.typ == 'b' {
+		mode = syscall.S_IFBLK
+	}
+	err = unix.Mknod(target, mode, int(unix.Mkdev(uint32(node.major), uint32(node.minor))))
+	if err == unix.EPERM {
+		return bindMountFile(node.hostPath, rootFS, node.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", node.path, err)
+	}
+
+	// mknod applies the umask
+	if err := os.Chmod(target, node.mode); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %v", node.path, err)
+	}
+
+	return nil
+}
+
+// setDeviceCgroupV1 restricts the processes in a cgroup v1 devices hierarchy
+// cgroup to the allowed devices
+func setDeviceCgroupV1(cgroupPath string, rules []deviceRule) error {
+	if err := setCgroupValue(cgroupPath, "devices.deny", "a"); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := setCgroupValue(cgroupPath, "devices.allow", rule.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eBPF instructions used by the device filter, see linux/bpf_common.h
+const (
+	bpfLdxMemW  = 0x61 // dst = *(u32 *)(src + off)
+	bpfAnd32Imm = 0x54 // dst &= imm
+	bpfRsh32Imm = 0x74 // dst >>= imm
+	bpfMov32Reg = 0xbc // dst = src
+	bpfMov64Imm = 0xb7 // dst = imm
+	bpfJneImm   = 0x55 // if dst != imm goto pc + off
+	bpfJneReg   = 0x5d // if dst != src goto pc + off
+	bpfExit     = 0x95 // return r0
+)
+
+// bpfInsn is an eBPF instruction, laid out like struct bpf_insn
+type bpfInsn struct {
+	code uint8
+	regs uint8 // Destination register in the low nibble, source in the high one
+	off  int16
+	imm  int32
+}
+
+// insn encodes an instruction operating on registers dst and src
+func insn(code uint8, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// deviceFilter assembles a BPF_PROG_TYPE_CGROUP_DEVICE program returning 1
+// for the accesses the rules allow and 0 for everything else
+func deviceFilter(rules []deviceRule) []bpfInsn {
+	// The context is struct bpf_cgroup_dev_ctx: the access in the upper
+	// half of access_type, the device type in the lower, then major and minor
+	prog := []bpfInsn{
+		insn(bpfLdxMemW, 2, 1, 0, 0),
+		insn(bpfAnd32Imm, 2, 0, 0, 0xffff),
+		insn(bpfLdxMemW, 3, 1, 0, 0),
+		insn(bpfRsh32Imm, 3, 0, 0, 16),
+		insn(bpfLdxMemW, 4, 1, 4, 0),
+		insn(bpfLdxMemW, 5, 1, 8, 0),
+	}
+
+	for _, rule := range rules {
+		// Each check jumps past the rule when it doesn't match, the offsets
+		// are filled in once the rule's length is known
+		var checks []bpfInsn
+		switch rule.typ {
+		case 'c':
+			checks = append(checks, insn(bpfJneImm, 2, 0, 0, unix.BPF_DEVCG_DEV_CHAR))
+		case 'b':
+			checks = append(checks, insn(bpfJneImm, 2, 0, 0, unix.BPF_DEVCG_DEV_BLOCK))
+		}
+		if access := deviceAccess(rule.access); access != unix.BPF_DEVCG_ACC_MKNOD|unix.BPF_DEVCG_ACC_READ|unix.BPF_DEVCG_ACC_WRITE {
+			// Every requested access bit must be allowed
+			checks = append(checks,
+				insn(bpfMov32Reg, 1, 3, 0, 0),
+				insn(bpfAnd32Imm, 1, 0, 0, access),
+				insn(bpfJneReg, 1, 3, 0, 0))
+		}
+		if rule.major != wildcardDevice {
+			checks = append(checks, insn(bpfJneImm, 4, 0, 0, int32(rule.major)))
+		}
+		if rule.minor != wildcardDevice {
+			checks = append(checks, insn(bpfJneImm, 5, 0, 0, int32(rule.minor)))
+		}
+
+		block := append(checks, insn(bpfMov64Imm, 0, 0, 0, 1), insn(bpfExit, 0, 0, 0, 0))
+		for i := range checks {
+			if checks[i].code == bpfJneImm || checks[i].code == bpfJneReg {
+				block[i].off = int16(len(block) - i - 1)
+			}
+		}
+		prog = append(prog, block...)
+	}
+
+	return append(prog, insn(bpfMov64Imm, 0, 0, 0, 0), insn(bpfExit, 0, 0, 0, 0))
+}
+
+// deviceAccess converts r, w and m into the BPF_DEVCG_ACC_* bits
+func deviceAccess(access string) int32 {
+	var bits int32
+	if strings.Contains(access, "m") {
+		bits |= unix.BPF_DEVCG_ACC_MKNOD
+	}
+	if strings.Contains(access, "r") {
+		bits |= unix.BPF_DEVCG_ACC_READ
+	}
+	if strings.Contains(access, "w") {
+		bits |= unix.BPF_DEVCG_ACC_WRITE
+	}
+	return bits
+}
+
+// bpfProgLoadAttr is the part of union bpf_attr used by BPF_PROG_LOAD
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+// bpfProgAttachAttr is the part of union bpf_attr used by BPF_PROG_ATTACH
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+// setDeviceCgroupV2 restricts the processes in a cgroup v2 cgroup to the
+// allowed devices. cgroup v2 has no devices controller, an eBPF program
+// attached to the cgroup decides on every access instead.
+func setDeviceCgroupV2(cgroupPath string, rules []deviceRule) error {
+	prog := deviceFilter(rules)
+	license := []byte("GPL\x00")
+	log := make([]byte, 64*1024)
+
+	load := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		insnCnt:  uint32(len(prog)),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(log)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&log[0]))),
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&load)), unsafe.Sizeof(load))
+	runtime.KeepAlive(prog)
+	runtime.KeepAlive(license)
+	if errno != 0 {
+		verifier := strings.TrimSpace(string(log[:clen(log)]))
+		return fmt.Errorf("failed to load device filter: %v: %s", errno, verifier)
+	}
+	defer unix.Close(int(fd))
+
+	dir, err := unix.Open(cgroupPath, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open cgroup %s: %v", cgroupPath, err)
+	}
+	defer unix.Close(dir)
+
+	// The cgroup keeps the program alive once it is attached
+	attach := bpfProgAttachAttr{
+		targetFd:    uint32(dir),
+		attachBpfFd: uint32(fd),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+		attachFlags: unix.BPF_F_ALLOW_MULTI,
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attach)), unsafe.Sizeof(attach)); errno != 0 {
+		return fmt.Errorf("failed to attach device filter to %s: %v", cgroupPath, errno)
+	}
+
+	return nil
+}
+
+// clen returns the length of a NUL terminated byte string
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
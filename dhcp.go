@@ -0,0 +1,571 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// DHCP ports and the magic cookie starting the options, from RFC 2131
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+	dhcpHeaderLen  = 236
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// DHCP message types
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+)
+
+// DHCP options, from RFC 2132
+const (
+	optPad          = 0
+	optSubnetMask   = 1
+	optRouter       = 3
+	optDNS          = 6
+	optHostname     = 12
+	optDomainName   = 15
+	optRequestedIP  = 50
+	optLeaseTime    = 51
+	optMessageType  = 53
+	optServerID     = 54
+	optParamRequest = 55
+	optRenewalTime  = 58
+	optClientID     = 61
+	optEnd          = 255
+)
+
+// dhcpTimeouts are how long each attempt of an exchange waits for a reply
+var dhcpTimeouts = []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+
+// DHCPLease records what the DHCP server handed out besides the address
+type DHCPLease struct {
+	Server string
+	Router string   `json:",omitempty"`
+	DNS    []string `json:",omitempty"`
+	Domain string   `json:",omitempty"`
+}
+
+// dhcpLease is a lease as the client tracks it
+type dhcpLease struct {
+	ip       net.IP
+	mask     net.IPMask
+	router   net.IP
+	dns      []string
+	domain   string
+	server   net.IP
+	duration time.Duration
+	renewAt  time.Duration // T1, after which the lease is renewed
+	obtained time.Time
+}
+
+// record returns the parts of the lease kept in the container's state
+func (l *dhcpLease) record() *DHCPLease {
+	lease := &DHCPLease{Server: l.server.String(), DNS: l.dns, Domain: l.domain}
+	if l.router != nil {
+		lease.Router = l.router.String()
+	}
+	return lease
+}
+
+// dhcpMessage is a DHCP packet, the BOOTP fields we use and the options
+type dhcpMessage struct {
+	op      byte
+	xid     uint32
+	flags   uint16
+	ciaddr  net.IP
+	yiaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+	source  net.IP // Where a received message came from
+}
+
+// encode serializes the message, options in ascending order
+func (m *dhcpMessage) encode() []byte {
+	buf := make([]byte, dhcpHeaderLen)
+	buf[0] = m.op
+	buf[1] = 1 // Ethernet
+	buf[2] = 6 // Hardware address length
+	binary.BigEndian.PutUint32(buf[4:8], m.xid)
+	binary.BigEndian.PutUint16(buf[10:12], m.flags)
+	if m.ciaddr != nil {
+		copy(buf[12:16], m.ciaddr.To4())
+	}
+	copy(buf[28:44], m.chaddr)
+
+	buf = append(buf, dhcpMagicCookie...)
+	for code := 1; code < optEnd; code++ {
+		if value, ok := m.options[byte(code)]; ok {
+			buf = append(buf, byte(code), byte(len(value)))
+			buf = append(buf, value...)
+		}
+	}
+	return append(buf, optEnd)
+}
+
+// parseDHCPMessage decodes a DHCP packet
+func parseDHCPMessage(buf []byte) (*dhcpMessage, error) {
+	if len(buf) < dhcpHeaderLen+len(dhcpMagicCookie) || !bytes.Equal(buf[dhcpHeaderLen:dhcpHeaderLen+4], dhcpMagicCookie) {
+		return nil, fmt.Errorf("not a DHCP message")
+	}
+
+	m := &dhcpMessage{
+		op:      buf[0],
+		xid:     binary.BigEndian.Uint32(buf[4:8]),
+		flags:   binary.BigEndian.Uint16(buf[10:12]),
+		ciaddr:  net.IP(buf[12:16]),
+		yiaddr:  net.IP(buf[16:20]),
+		chaddr:  net.HardwareAddr(buf[28 : 28+int(buf[2]&0xf)]),
+		options: make(map[byte][]byte),
+	}
+
+	for opts := buf[dhcpHeaderLen+4:]; len(opts) > 0; {
+		code := opts[0]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		m.options[code] = opts[2 : 2+int(opts[1])]
+		opts = opts[2+int(opts[1]):]
+	}
+
+	return m, nil
+}
+
+// messageType returns the DHCP message type option
+func (m *dhcpMessage) messageType() byte {
+	if value := m.options[optMessageType]; len(value) == 1 {
+		return value[0]
+	}
+	return 0
+}
+
+// optionIP returns the first address of an address option
+func (m *dhcpMessage) optionIP(code byte) net.IP {
+	if value := m.options[code]; len(value) >= 4 {
+		return net.IP(value[:4]).To4()
+	}
+	return nil
+}
+
+// optionDuration returns a time option, given in seconds
+func (m *dhcpMessage) optionDuration(code byte) time.Duration {
+	if value := m.options[code]; len(value) == 4 {
+		return time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+	}
+	return 0
+}
+
+// lease extracts the lease from an ACK
+func (m *dhcpMessage) lease() (*dhcpLease, error) {
+	lease := &dhcpLease{
+		ip:       m.yiaddr.To4(),
+		router:   m.optionIP(optRouter),
+		domain:   string(m.options[optDomainName]),
+		server:   m.optionIP(optServerID),
+		duration: m.optionDuration(optLeaseTime),
+		renewAt:  m.optionDuration(optRenewalTime),
+		obtained: time.Now(),
+	}
+	// Without a server identifier, the lease belongs to whoever answered
+	if lease.server == nil {
+		lease.server = m.source
+	}
+	if lease.ip == nil || lease.ip.IsUnspecified() {
+		return nil, fmt.Errorf("DHCP server %s didn't assign an address", lease.server)
+	}
+
+	lease.mask = lease.ip.DefaultMask()
+	if mask := m.options[optSubnetMask]; len(mask) == 4 {
+		lease.mask = net.IPMask(mask)
+	}
+	dns := m.options[optDNS]
+	for i := 0; i+4 <= len(dns); i += 4 {
+		lease.dns = append(lease.dns, net.IP(dns[i:i+4]).String())
+	}
+
+	// Infinite or missing lease times are renewed hourly
+	if lease.duration == 0 || lease.duration == 0xffffffff*time.Second {
+		lease.duration = 2 * time.Hour
+	}
+	if lease.renewAt == 0 || lease.renewAt >= lease.duration {
+		lease.renewAt = lease.duration / 2
+	}
+	return lease, nil
+}
+
+// dhcpClient leases and renews the address of a container's interface
+type dhcpClient struct {
+	id       string
+	conn     net.PacketConn
+	handle   *netlink.Handle // Netlink in the container namespace, for eth0's address
+	link     netlink.Link
+	hwAddr   net.HardwareAddr
+	clientID []byte
+	hostname string
+	lease    *dhcpLease
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newDHCPClient opens the client's socket on the container's interface. It
+// must be called from the container's network namespace; the socket and the
+// netlink handle stay in it, and keep the namespace alive long enough to
+// release the lease.
+func newDHCPClient(link netlink.Link, config *ContainerConfig) (*dhcpClient, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DHCP socket: %v", err)
+	}
+
+	// Without an address yet, broadcasts must leave through the right interface
+	for _, opt := range []int{unix.SO_REUSEADDR, unix.SO_BROADCAST} {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, 1); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to configure DHCP socket: %v", err)
+		}
+	}
+	if err := unix.BindToDevice(fd, containerIface); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind DHCP socket to %s: %v", containerIface, err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Port: dhcpClientPort}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind DHCP socket: %v", err)
+	}
+
+	file := os.NewFile(uintptr(fd), "dhcp")
+	conn, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DHCP socket: %v", err)
+	}
+
+	handle, err := netlink.NewHandle()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open netlink for DHCP: %v", err)
+	}
+
+	// ipvlan interfaces share the parent's MAC address, so the client ID is
+	// what tells containers apart
+	return &dhcpClient{
+		id:       config.ID,
+		conn:     conn,
+		handle:   handle,
+		link:     link,
+		hwAddr:   link.Attrs().HardwareAddr,
+		clientID: append([]byte{0}, "nsc-"+shortID(config.ID)...),
+		hostname: config.Hostname,
+	}, nil
+}
+
+// newMessage returns a client message of the given type with a fresh transaction ID
+func (c *dhcpClient) newMessage(msgType byte) *dhcpMessage {
+	var xid [4]byte
+	rand.Read(xid[:])
+
+	return &dhcpMessage{
+		op:     1, // BOOTREQUEST
+		xid:    binary.BigEndian.Uint32(xid[:]),
+		flags:  0x8000, // Ask for broadcast replies, we can't receive unicast before we have an address
+		chaddr: c.hwAddr,
+		options: map[byte][]byte{
+			optMessageType:  {msgType},
+			optClientID:     c.clientID,
+			optHostname:     []byte(c.hostname),
+			optParamRequest: {optSubnetMask, optRouter, optDNS, optDomainName, optLeaseTime, optRenewalTime},
+		},
+	}
+}
+
+// exchange sends a message and waits for a reply of one of the given types,
+// retrying with growing timeouts
+func (c *dhcpClient) exchange(msg *dhcpMessage, to net.IP, replyTypes ...byte) (*dhcpMessage, error) {
+	buf := make([]byte, 1500)
+	for _, timeout := range dhcpTimeouts {
+		if _, err := c.conn.WriteTo(msg.encode(), &net.UDPAddr{IP: to, Port: dhcpServerPort}); err != nil {
+			return nil, fmt.Errorf("failed to send DHCP message: %v", err)
+		}
+
+		deadline := time.Now().Add(timeout)
+		c.conn.SetReadDeadline(deadline)
+		for time.Now().Before(deadline) {
+			n, from, err := c.conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+
+			reply, err := parseDHCPMessage(buf[:n])
+			if err != nil || reply.op != 2 || reply.xid != msg.xid || !bytes.Equal(reply.chaddr, c.hwAddr) {
+				continue
+			}
+			for _, replyType := range replyTypes {
+				if reply.messageType() == replyType {
+					if addr, ok := from.(*net.UDPAddr); ok {
+						reply.source = addr.IP.To4()
+					}
+					return reply, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no reply from a DHCP server")
+}
+
+// acquire leases an address: DISCOVER, OFFER, REQUEST and ACK
+func (c *dhcpClient) acquire() (*dhcpLease, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		offer, err := c.exchange(c.newMessage(dhcpDiscover), net.IPv4bcast, dhcpOffer)
+		if err != nil {
+			return nil, err
+		}
+
+		request := c.newMessage(dhcpRequest)
+		request.xid = offer.xid
+		request.options[optRequestedIP] = offer.yiaddr.To4()
+		request.options[optServerID] = offer.options[optServerID]
+
+		reply, err := c.exchange(request, net.IPv4bcast, dhcpAck, dhcpNak)
+		if err != nil {
+			return nil, err
+		}
+		if reply.messageType() == dhcpNak {
+			// Someone else got the offered address first
+			continue
+		}
+
+		if c.lease, err = reply.lease(); err != nil {
+			return nil, err
+		}
+		return c.lease, nil
+	}
+
+	return nil, fmt.Errorf("DHCP server keeps refusing the address it offered")
+}
+
+// renew extends the lease, asking the server that granted it or, once that
+// failed, any server on the LAN. nak reports that a server refused it.
+func (c *dhcpClient) renew(broadcast bool) (lease *dhcpLease, nak bool, err error) {
+	request := c.newMessage(dhcpRequest)
+	request.ciaddr = c.lease.ip
+
+	to := c.lease.server
+	if broadcast || to == nil {
+		to = net.IPv4bcast
+	}
+
+	reply, err := c.exchange(request, to, dhcpAck, dhcpNak)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply.messageType() == dhcpNak {
+		return nil, true, fmt.Errorf("DHCP server refused to renew %s", c.lease.ip)
+	}
+	lease, err = reply.lease()
+	return lease, false, err
+}
+
+// dropAddress removes the lease's address from the interface once it was
+// refused, ran out or moved, as RFC 2131 requires. The default route goes
+// with the interface's last address.
+func (c *dhcpClient) dropAddress() {
+	if err := c.handle.AddrDel(c.link, newAddr(c.lease.ip, c.lease.mask)); err != nil {
+		logError("Failed to remove %s from %s: %v", c.lease.ip, containerIface, err)
+	}
+	c.lease = nil
+}
+
+// rebind leases an address again after the last one was dropped
+func (c *dhcpClient) rebind() error {
+	lease, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	return c.assign(lease)
+}
+
+// assign makes lease the client's current one, adds its address and default
+// route to the interface and records it in the container's state
+func (c *dhcpClient) assign(lease *dhcpLease) error {
+	c.lease = lease
+	if err := c.handle.AddrAdd(c.link, newAddr(lease.ip, lease.mask)); err != nil {
+		c.release()
+		c.lease = nil
+		return fmt.Errorf("failed to add address to %s: %v", containerIface, err)
+	}
+	if lease.router != nil {
+		route := &netlink.Route{LinkIndex: c.link.Attrs().Index, Gw: lease.router}
+		if err := c.handle.RouteAdd(route); err != nil {
+			logError("Failed to add default route via %s: %v", lease.router, err)
+		}
+	}
+	logInfo("Leased %s from DHCP server %s", &net.IPNet{IP: lease.ip, Mask: lease.mask}, lease.server)
+
+	// Containers whose state isn't saved yet record the lease when it is
+	state := &ContainerState{}
+	if err := readJSONFile(containerStatePath(c.id), state); err != nil || state.Config == nil {
+		return nil
+	}
+	config := state.Config
+	config.ContainerIP = lease.ip.String()
+	config.NetworkCIDR = (&net.IPNet{IP: lease.ip, Mask: lease.mask}).String()
+	config.HostIP = ""
+	if lease.router != nil {
+		config.HostIP = lease.router.String()
+	}
+	config.DHCPLease = lease.record()
+	if err := writeJSONFile(containerStatePath(c.id), state); err != nil {
+		logError("Failed to record new DHCP lease: %v", err)
+	}
+	if err := WriteResolvConf(config); err != nil {
+		logError("Failed to update resolv.conf: %v", err)
+	}
+	return nil
+}
+
+// maintain renews the lease until stopped
+func (c *dhcpClient) maintain() {
+	defer close(c.done)
+
+	wait := c.lease.renewAt
+	failures := 0
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		// Without an address, start over with DISCOVER
+		if c.lease == nil {
+			if err := c.rebind(); err != nil {
+				logError("Failed to lease a new address: %v", err)
+				wait = time.Minute
+				continue
+			}
+			wait, failures = c.lease.renewAt, 0
+			continue
+		}
+
+		lease, nak, err := c.renew(failures > 0)
+		if err == nil {
+			wait, failures = lease.renewAt, 0
+			if lease.ip.Equal(c.lease.ip) {
+				c.lease = lease
+				continue
+			}
+
+			// The old address is no longer ours, switch the interface over
+			logInfo("DHCP server moved the container from %s to %s", c.lease.ip, lease.ip)
+			c.dropAddress()
+			if err := c.assign(lease); err != nil {
+				logError("Failed to switch to %s: %v", lease.ip, err)
+				wait = 0
+			}
+			continue
+		}
+
+		// Retry halfway to the end of the lease, like dhclient
+		failures++
+		remaining := time.Until(c.lease.obtained.Add(c.lease.duration))
+		if nak || remaining <= 0 {
+			if nak {
+				logError("%v, dropping it", err)
+			} else {
+				logError("DHCP lease of %s expired, dropping it: %v", c.lease.ip, err)
+			}
+			c.dropAddress()
+			wait = 0
+			continue
+		}
+		logInfo("Failed to renew the DHCP lease of %s: %v", c.lease.ip, err)
+		if wait = remaining / 2; wait < 10*time.Second {
+			wait = 10 * time.Second
+		}
+	}
+}
+
+// release hands the address back to the server
+func (c *dhcpClient) release() {
+	if c.lease == nil || c.lease.server == nil {
+		return
+	}
+
+	msg := c.newMessage(dhcpRelease)
+	msg.flags = 0
+	msg.ciaddr = c.lease.ip
+	msg.options = map[byte][]byte{
+		optMessageType: {dhcpRelease},
+		optClientID:    c.clientID,
+		optServerID:    c.lease.server.To4(),
+	}
+	if _, err := c.conn.WriteTo(msg.encode(), &net.UDPAddr{IP: c.lease.server, Port: dhcpServerPort}); err != nil {
+		logDebug("Failed to release DHCP lease of %s: %v", c.lease.ip, err)
+	}
+}
+
+func (c *dhcpClient) close() {
+	c.conn.Close()
+	c.handle.Delete()
+}
+
+// dhcpClients are the clients renewing leases of containers run by this process
+var dhcpClients = struct {
+	sync.Mutex
+	byID map[string]*dhcpClient
+}{byID: make(map[string]*dhcpClient)}
+
+// startDHCPRenewal keeps the container's lease alive in the background
+func startDHCPRenewal(id string, client *dhcpClient) {
+	client.stop = make(chan struct{})
+	client.done = make(chan struct{})
+
+	dhcpClients.Lock()
+	dhcpClients.byID[id] = client
+	dhcpClients.Unlock()
+
+	go client.maintain()
+}
+
+// stopDHCPRenewal stops renewing the container's lease and releases it
+func stopDHCPRenewal(id string) {
+	dhcpClients.Lock()
+	client, ok := dhcpClients.byID[id]
+	delete(dhcpClients.byID, id)
+	dhcpClients.Unlock()
+	if !ok {
+		return
+	}
+
+	close(client.stop)
+	<-client.done
+	client.release()
+	client.close()
+}
@@ -0,0 +1,213 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// hostResolvConf is the host's resolver configuration
+	hostResolvConf = "/etc/resolv.conf"
+
+	// upstreamResolvConf lists the servers systemd-resolved forwards to, for
+	// hosts whose resolv.conf only points at the local stub resolver
+	upstreamResolvConf = "/run/systemd/resolve/resolv.conf"
+)
+
+// fallbackNameservers are used when neither the host nor the user provide any
+var fallbackNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// ResolvConf is the subset of resolv.conf(5) the runtime manages
+type ResolvConf struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+}
+
+// parseResolvConf reads nameserver, search/domain and options lines, ignoring everything else
+func parseResolvConf(data []byte) *ResolvConf {
+	conf := &ResolvConf{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			conf.Nameservers = append(conf.Nameservers, fields[1])
+		case "search", "domain":
+			// The last search or domain line wins
+			conf.Search = fields[1:]
+		case "options":
+			conf.Options = append(conf.Options, fields[1:]...)
+		}
+	}
+
+	return conf
+}
+
+// Bytes formats the configuration as a resolv.conf file
+func (r *ResolvConf) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, ns := range r.Nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	if len(r.Search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(r.Search, " "))
+	}
+	if len(r.Options) > 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(r.Options, " "))
+	}
+	return buf.Bytes()
+}
+
+// readResolvConf parses a resolv.conf file, a missing file is treated as empty
+func readResolvConf(path string) (*ResolvConf, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &ResolvConf{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return parseResolvConf(data), nil
+}
+
+// containerResolvConf builds the container's resolver configuration. The host's
+// configuration is inherited, minus servers the container can't reach, and
+// --dns, --dns-search and --dns-option replace the corresponding settings, as
+// do the servers and domain of a DHCP lease.
+func containerResolvConf(config *ContainerConfig) (*ResolvConf, error) {
+	conf, err := readResolvConf(hostResolvConf)
+	if err != nil {
+		return nil, err
+	}
+
+	// With the host's network the container can use the host's resolver as is
+	if config.Network != networkHost {
+		conf.Nameservers, err = reachableNameservers(config, conf.Nameservers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The embedded DNS server forwards to --dns itself, see dnsServer.upstreams
+	switch {
+	case config.EmbeddedDNS != "":
+		conf.Nameservers = []string{config.EmbeddedDNS}
+	case len(config.DNS) > 0:
+		conf.Nameservers = config.DNS
+	case config.DHCPLease != nil && len(config.DHCPLease.DNS) > 0:
+		conf.Nameservers = config.DHCPLease.DNS
+	}
+	switch {
+	case len(config.DNSSearch) > 0:
+		conf.Search = config.DNSSearch
+	case config.DHCPLease != nil && config.DHCPLease.Domain != "":
+		conf.Search = []string{config.DHCPLease.Domain}
+	}
+	if len(config.DNSOptions) > 0 {
+		conf.Options = config.DNSOptions
+	}
+
+	if len(conf.Nameservers) == 0 {
+		conf.Nameservers = fallbackNameservers
+	}
+
+	return conf, nil
+}
+
+// reachableNameservers drops servers the container can't reach from its own
+// network namespace. Loopback stub resolvers are replaced by the servers they
+// forward to, or by the host's gateway which usually runs a resolver as well.
+func reachableNameservers(config *ContainerConfig, nameservers []string) ([]string, error) {
+	var reachable []string
+	hadLoopback := false
+	for _, ns := range nameservers {
+		ip := net.ParseIP(ns)
+		switch {
+		case ip == nil:
+			continue
+		case ip.IsLoopback():
+			hadLoopback = true
+		case ip.To4() == nil && config.ContainerIPv6 == "":
+			// No IPv6 route out of the container
+		default:
+			reachable = append(reachable, ns)
+		}
+	}
+
+	if len(reachable) > 0 || !hadLoopback {
+		return reachable, nil
+	}
+
+	upstream, err := readResolvConf(upstreamResolvConf)
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range upstream.Nameservers {
+		if ip := net.ParseIP(ns); ip != nil && !ip.IsLoopback() && (ip.To4() != nil || config.ContainerIPv6 != "") {
+			reachable = append(reachable, ns)
+		}
+	}
+	if len(reachable) > 0 {
+		logDebug("Host uses a local resolver, using its upstream servers %v", reachable)
+		return reachable, nil
+	}
+
+	gateways, err := hostGateways()
+	if err != nil {
+		return nil, err
+	}
+	logDebug("Host uses a local resolver, using the host's gateway %v", gateways)
+	return gateways, nil
+}
+
+// hostGateways returns the next hops of the host's IPv4 default routes
+func hostGateways() ([]string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	var gateways []string
+	for _, route := range routes {
+		if isDefaultRoute(route) && route.Gw != nil {
+			gateways = append(gateways, route.Gw.String())
+		}
+	}
+	return unique(gateways), nil
+}
+
+// WriteResolvConf generates the container's resolv.conf in its state directory,
+// from where it is bind mounted over /etc/resolv.conf inside the container
+func WriteResolvConf(config *ContainerConfig) error {
+	conf, err := containerResolvConf(config)
+	if err != nil {
+		return err
+	}
+
+	path := containerFile(config.ID, "resolv.conf")
+	if err := ensureDir(containerDir(config.ID), 0755); err != nil {
+		return fmt.Errorf("failed to create container directory: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, conf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write resolv.conf: %v", err)
+	}
+
+	return nil
+}
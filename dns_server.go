@@ -0,0 +1,503 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// dnsTTL is kept short, containers come and go
+	dnsTTL = 5
+
+	// dnsForwardTimeout bounds how long a single upstream server may take
+	dnsForwardTimeout = 5 * time.Second
+
+	// dnsIdleCheck is how often the server checks whether its network is still in use
+	dnsIdleCheck = 5 * time.Second
+)
+
+// DNS message fields used by the server, see RFC 1035
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNotImp   = 4
+)
+
+// dnsServerPath returns the pid file of a network's DNS server
+func dnsServerPath(network string) string {
+	return runtimePath("dns", network+".pid")
+}
+
+// EnsureDNSServer starts the network's DNS server in the background unless it
+// is already running. The server stops by itself once the network is unused.
+func EnsureDNSServer(name string) error {
+	path := dnsServerPath(name)
+	return withLockedFile(path, func() error {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			if pid, err := parsePID(strings.TrimSpace(string(data))); err == nil && processAlive(pid) {
+				return nil
+			}
+		}
+
+		logFile, err := os.OpenFile(runtimePath("dns", name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open DNS server log: %v", err)
+		}
+		defer logFile.Close()
+
+		// The server reports on this pipe once it is listening, or why it couldn't
+		ready, readyWriter, err := os.Pipe()
+		if err != nil {
+			return fmt.Errorf("failed to create pipe: %v", err)
+		}
+		defer ready.Close()
+
+		cmd := exec.Command("/proc/self/exe", "dns-server", name)
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		cmd.ExtraFiles = []*os.File{readyWriter}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+		err = cmd.Start()
+		readyWriter.Close()
+		if err != nil {
+			return fmt.Errorf("failed to start DNS server: %v", err)
+		}
+
+		// The server outlives this process, don't wait for it
+		pid := cmd.Process.Pid
+		cmd.Process.Release()
+
+		status, err := ioutil.ReadAll(ready)
+		if err != nil {
+			return fmt.Errorf("failed to read DNS server status: %v", err)
+		}
+		if len(status) > 0 {
+			return fmt.Errorf("%s", status)
+		}
+
+		return ioutil.WriteFile(path, []byte(strconv.Itoa(pid)), 0644)
+	})
+}
+
+// dnsServer answers queries for container names on a single network and
+// forwards everything else upstream
+type dnsServer struct {
+	network   *Network
+	udpConns  []*net.UDPConn
+	listeners []*net.TCPListener
+}
+
+// RunDNSServer serves DNS on the network's gateway addresses until no
+// container is attached to the network any more
+func RunDNSServer(name string) error {
+	network, err := LoadNetwork(name)
+	if err != nil {
+		return err
+	}
+
+	// File descriptor 3 is the ready pipe set up by EnsureDNSServer
+	ready := os.NewFile(3, "ready")
+
+	server := &dnsServer{network: network}
+	if err := server.listen(); err != nil {
+		fmt.Fprintf(ready, "%v", err)
+		ready.Close()
+		return err
+	}
+	ready.Close()
+
+	logInfo("DNS server for network %s listening on port 53 of %s", name, network.Gateway)
+	server.serve()
+
+	for {
+		time.Sleep(dnsIdleCheck)
+
+		stop := false
+		err := withLockedFile(dnsServerPath(name), func() error {
+			containers, err := NetworkContainers(network)
+			if err != nil || len(containers) > 0 {
+				return err
+			}
+
+			// Close while holding the lock, so a new server can bind as soon as it is started
+			server.close()
+			stop = true
+			return os.Remove(dnsServerPath(name))
+		})
+		if err != nil {
+			logError("Failed to check network %s: %v", name, err)
+		}
+		if stop {
+			logInfo("No containers left on network %s, stopping DNS server", name)
+			return nil
+		}
+	}
+}
+
+// listen binds UDP and TCP port 53 on every gateway address of the network
+func (s *dnsServer) listen() error {
+	gateways := []string{s.network.Gateway}
+	if s.network.IPv6Gateway != "" {
+		gateways = append(gateways, s.network.IPv6Gateway)
+	}
+
+	for _, gateway := range gateways {
+		addr := net.JoinHostPort(gateway, "53")
+
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return err
+		}
+		udpConn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			s.close()
+			return fmt.Errorf("failed to listen on udp %s: %v", addr, err)
+		}
+		s.udpConns = append(s.udpConns, udpConn)
+
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return err
+		}
+		listener, err := net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			s.close()
+			return fmt.Errorf("failed to listen on tcp %s: %v", addr, err)
+		}
+		s.listeners = append(s.listeners, listener)
+	}
+
+	return nil
+}
+
+// serve handles queries in the background until close is called
+func (s *dnsServer) serve() {
+	for _, conn := range s.udpConns {
+		go s.serveUDP(conn)
+	}
+	for _, listener := range s.listeners {
+		go s.serveTCP(listener)
+	}
+}
+
+// close stops listening on every address
+func (s *dnsServer) close() {
+	for _, conn := range s.udpConns {
+		conn.Close()
+	}
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+}
+
+func (s *dnsServer) serveUDP(conn *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			if reply := s.handle(query, client.IP, forwardUDP); reply != nil {
+				conn.WriteToUDP(reply, client)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP(listener *net.TCPListener) {
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			client := conn.RemoteAddr().(*net.TCPAddr).IP
+
+			// A connection may carry several queries, each prefixed by its length
+			for {
+				conn.SetDeadline(time.Now().Add(dnsForwardTimeout * 2))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+
+				reply := s.handle(query, client, forwardTCP)
+				if reply == nil || writeTCPMessage(conn, reply) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle answers a single query. Names of containers on the network are
+// answered directly, everything else is forwarded with forward.
+func (s *dnsServer) handle(query []byte, client net.IP, forward func([]byte, string) ([]byte, error)) []byte {
+	question, err := parseDNSQuestion(query)
+	if err != nil {
+		logDebug("Bad query from %s: %v", client, err)
+		if len(query) < 12 {
+			return nil
+		}
+		return dnsReply(query, nil, dnsRcodeFormErr, nil)
+	}
+
+	if opcode := (query[2] >> 3) & 0xf; opcode != 0 {
+		return dnsReply(query, question, dnsRcodeNotImp, nil)
+	}
+
+	states, err := ListContainerStates()
+	if err != nil {
+		logError("Failed to list containers: %v", err)
+		return dnsReply(query, question, dnsRcodeServFail, nil)
+	}
+
+	if question.class == dnsClassIN {
+		if configs := s.lookup(states, question.name); len(configs) > 0 {
+			return dnsReply(query, question, 0, answerIPs(configs, question.qtype))
+		}
+	}
+
+	for _, upstream := range s.upstreams(states, client) {
+		reply, err := forward(query, upstream)
+		if err == nil {
+			return reply
+		}
+		logDebug("Forwarding %s to %s failed: %v", question.name, upstream, err)
+	}
+
+	return dnsReply(query, question, dnsRcodeServFail, nil)
+}
+
+// lookup returns the containers on the network known by name
+func (s *dnsServer) lookup(states []*ContainerState, name string) []*ContainerConfig {
+	var configs []*ContainerConfig
+	for _, state := range states {
+		if state.Config.Network != s.network.Name {
+			continue
+		}
+
+		names := state.Config.NetworkAliases
+		if state.Config.Name != "" {
+			names = append([]string{state.Config.Name}, names...)
+		}
+		for _, candidate := range names {
+			if strings.EqualFold(candidate, name) {
+				configs = append(configs, state.Config)
+				break
+			}
+		}
+	}
+	return configs
+}
+
+// upstreams returns the servers to forward the client's queries to: its own
+// --dns servers if it has any, otherwise the host's resolvers. The server runs
+// on the host, so the host's local stub resolver works here.
+func (s *dnsServer) upstreams(states []*ContainerState, client net.IP) []string {
+	for _, state := range states {
+		if state.Config.Network == s.network.Name && len(state.Config.DNS) > 0 &&
+			(client.Equal(net.ParseIP(state.Config.ContainerIP)) || client.Equal(net.ParseIP(state.Config.ContainerIPv6))) {
+			return state.Config.DNS
+		}
+	}
+
+	conf, err := readResolvConf(hostResolvConf)
+	if err != nil || len(conf.Nameservers) == 0 {
+		return fallbackNameservers
+	}
+	return conf.Nameservers
+}
+
+// answerIPs returns the addresses of the containers matching the query type.
+// Other query types get an empty answer, the name exists but has no such records.
+func answerIPs(configs []*ContainerConfig, qtype uint16) []net.IP {
+	var ips []net.IP
+	for _, config := range configs {
+		switch qtype {
+		case dnsTypeA:
+			if ip := net.ParseIP(config.ContainerIP).To4(); ip != nil {
+				ips = append(ips, ip)
+			}
+		case dnsTypeAAAA:
+			if ip := net.ParseIP(config.ContainerIPv6); ip != nil {
+				ips = append(ips, ip.To16())
+			}
+		}
+	}
+	return ips
+}
+
+// dnsQuestion is the single question of a query
+type dnsQuestion struct {
+	name  string // Lower case, without the trailing dot
+	qtype uint16
+	class uint16
+	end   int // Offset of the first byte after the question
+}
+
+// parseDNSQuestion parses the header and question of a query
+func parseDNSQuestion(msg []byte) (*dnsQuestion, error) {
+	if len(msg) < 12 {
+		return nil, fmt.Errorf("message too short")
+	}
+	if msg[2]&0x80 != 0 {
+		return nil, fmt.Errorf("not a query")
+	}
+	if count := binary.BigEndian.Uint16(msg[4:6]); count != 1 {
+		return nil, fmt.Errorf("expected 1 question, got %d", count)
+	}
+
+	var labels []string
+	offset := 12
+	for {
+		if offset >= len(msg) {
+			return nil, fmt.Errorf("truncated question")
+		}
+		length := int(msg[offset])
+		offset++
+
+		if length == 0 {
+			break
+		}
+		// Questions are never compressed, as nothing precedes them
+		if length&0xc0 != 0 || offset+length > len(msg) {
+			return nil, fmt.Errorf("invalid label")
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+
+	if offset+4 > len(msg) {
+		return nil, fmt.Errorf("truncated question")
+	}
+
+	return &dnsQuestion{
+		name:  strings.ToLower(strings.Join(labels, ".")),
+		qtype: binary.BigEndian.Uint16(msg[offset:]),
+		class: binary.BigEndian.Uint16(msg[offset+2:]),
+		end:   offset + 4,
+	}, nil
+}
+
+// dnsReply builds an authoritative reply to query with one record per
+// address. A nil question leaves the question section out.
+func dnsReply(query []byte, question *dnsQuestion, rcode int, ips []net.IP) []byte {
+	reply := make([]byte, 12, 512)
+	copy(reply, query[:2])
+
+	// Response, authoritative, recursion available, keeping the opcode and recursion desired bits
+	flags := binary.BigEndian.Uint16(query[2:4])&0x7900 | 0x8000 | 0x0400 | 0x0080 | uint16(rcode)
+	binary.BigEndian.PutUint16(reply[2:], flags)
+
+	if question == nil {
+		return reply
+	}
+
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(ips)))
+	reply = append(reply, query[12:question.end]...)
+
+	for _, ip := range ips {
+		qtype := uint16(dnsTypeA)
+		if len(ip) == net.IPv6len {
+			qtype = dnsTypeAAAA
+		}
+
+		record := make([]byte, 12)
+		binary.BigEndian.PutUint16(record[0:], 0xc00c) // Pointer to the name in the question
+		binary.BigEndian.PutUint16(record[2:], qtype)
+		binary.BigEndian.PutUint16(record[4:], dnsClassIN)
+		binary.BigEndian.PutUint32(record[6:], dnsTTL)
+		binary.BigEndian.PutUint16(record[10:], uint16(len(ip)))
+		reply = append(append(reply, record...), ip...)
+	}
+
+	return reply
+}
+
+// forwardUDP sends the query to an upstream server over UDP and returns its reply
+func forwardUDP(query []byte, upstream string) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(upstream, "53"), dnsForwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray replies to other queries
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// forwardTCP sends the query to an upstream server over TCP and returns its reply
+func forwardTCP(query []byte, upstream string) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(upstream, "53"), dnsForwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(conn)
+}
+
+// readTCPMessage reads a length prefixed DNS message
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeTCPMessage writes a length prefixed DNS message
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
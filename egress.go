@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// egressLogPrefix tags kernel log messages about dropped container traffic.
+// iptables limits the prefix to 29 characters, enough for the short ID.
+func egressLogPrefix(config *ContainerConfig) string {
+	return fmt.Sprintf("nsc-deny %s: ", shortID(config.ID))
+}
+
+// resolveEgressRules looks up the addresses of every allowed destination.
+// Hostnames are resolved once, when the container starts.
+func resolveEgressRules(config *ContainerConfig) error {
+	for i := range config.AllowEgress {
+		rule := &config.AllowEgress[i]
+		rule.Addrs = nil
+
+		if rule.Host == "*" {
+			rule.Addrs = append(rule.Addrs, "0.0.0.0/0")
+			if config.ContainerIPv6 != "" {
+				rule.Addrs = append(rule.Addrs, "::/0")
+			}
+			continue
+		}
+
+		// Addresses and CIDRs are used as they are
+		if ip, _, err := parseAddrOrCIDR(rule.Host); err == nil {
+			if ip.To4() == nil && config.ContainerIPv6 == "" {
+				return fmt.Errorf("cannot allow egress to %s: network %s has no IPv6 subnet", rule.Host, config.Network)
+			}
+			rule.Addrs = []string{rule.Host}
+			continue
+		}
+
+		ips, err := net.LookupIP(rule.Host)
+		if err != nil {
+			return fmt.Errorf("failed to resolve egress host %s: %v", rule.Host, err)
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil || config.ContainerIPv6 != "" {
+				rule.Addrs = append(rule.Addrs, ip.String())
+			}
+		}
+		if len(rule.Addrs) == 0 {
+			return fmt.Errorf("egress host %s has no address the container can reach", rule.Host)
+		}
+		logDebug("Allowing egress to %s at %v", rule.Host, rule.Addrs)
+	}
+
+	return nil
+}
+
+// egressRules returns the rules enforcing the container's egress policy. The
+// container may answer connections made to it, talk to its own network and
+// reach the allowed destinations, everything else it sends is logged and
+// dropped, whether it is routed off the host or addressed to the host itself.
+func egressRules(config *ContainerConfig) []FirewallRule {
+	if !config.DenyEgress {
+		return nil
+	}
+
+	sources := []string{config.ContainerIP}
+	if config.ContainerIPv6 != "" {
+		sources = append(sources, config.ContainerIPv6)
+	}
+
+	var rules []FirewallRule
+	for _, chain := range []string{chainForward, chainInput} {
+		for _, src := range sources {
+			v6 := net.ParseIP(src).To4() == nil
+
+			rules = append(rules, FirewallRule{Chain: chain, Src: src, Established: true, Action: actionReturn})
+
+			switch {
+			case chain == chainForward:
+				rules = append(rules, FirewallRule{Chain: chain, Src: src, OutIface: config.Bridge, Action: actionReturn})
+			case v6:
+				// Neighbor discovery with the gateway
+				rules = append(rules, FirewallRule{Chain: chain, Src: src, Proto: "icmpv6", Action: actionReturn})
+			}
+
+			// The network's DNS server runs on the host
+			if chain == chainInput && config.EmbeddedDNS != "" {
+				gateway := config.HostIP
+				if v6 {
+					gateway = config.IPv6Gateway
+				}
+				for _, proto := range []string{"udp", "tcp"} {
+					rules = append(rules, FirewallRule{Chain: chain, Src: src, Dst: gateway,
+						Proto: proto, DPort: 53, Action: actionReturn})
+				}
+			}
+
+			for _, allow := range config.AllowEgress {
+				for _, addr := range allow.Addrs {
+					if ip, _, _ := parseAddrOrCIDR(addr); (ip.To4() == nil) != v6 {
+						continue
+					}
+					for _, proto := range egressProtocols(allow) {
+						rules = append(rules, FirewallRule{Chain: chain, Src: src, Dst: addr,
+							Proto: proto, DPort: allow.Port, Action: actionReturn})
+					}
+				}
+			}
+
+			rules = append(rules,
+				FirewallRule{Chain: chain, Src: src, Action: actionLog, LogPrefix: egressLogPrefix(config)},
+				FirewallRule{Chain: chain, Src: src, Action: actionDrop},
+			)
+		}
+	}
+	return rules
+}
+
+// egressProtocols returns the protocols a rule allows. Ports only exist for
+// tcp and udp, so a port without a protocol means both.
+func egressProtocols(rule EgressRule) []string {
+	switch {
+	case rule.Protocol != "":
+		return []string{rule.Protocol}
+	case rule.Port != 0:
+		return []string{"tcp", "udp"}
+	default:
+		return []string{""}
+	}
+}
@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// rootView keeps the container's root without the mounts below it open for
+// as long as the container runs, export reads it through this process's fds
+var rootView *os.File
+
+// holdRootView takes a copy of the container's root mount that the mounts
+// made later, such as /proc, /dev and volumes, don't show up in. Runs in the
+// container's mount namespace before those mounts exist, the file descriptor
+// is recorded for export.
+func holdRootView(config *ContainerConfig) error {
+	dir := containerFile(config.ID, "rootview")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create root view: %v", err)
+	}
+	defer os.Remove(dir)
+
+	// A non-recursive bind has no submounts, and gets none of the ones made
+	// on the original later on
+	if err := syscall.Mount(config.RootFS, dir, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount root view: %v", err)
+	}
+	view, err := os.Open(dir)
+	if err != nil {
+		syscall.Unmount(dir, syscall.MNT_DETACH)
+		return fmt.Errorf("failed to open root view: %v", err)
+	}
+
+	// The open directory keeps the detached mount alive
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+		view.Close()
+		return fmt.Errorf("failed to detach root view: %v", err)
+	}
+
+	if err := ioutil.WriteFile(containerFile(config.ID, "rootview.fd"), []byte(strconv.Itoa(int(view.Fd()))), 0644); err != nil {
+		view.Close()
+		return fmt.Errorf("failed to record root view: %v", err)
+	}
+
+	rootView = view
+	return nil
+}
+
+// containerRootView returns the path of the container's root without its
+// mounts, through the file descriptor its init keeps open
+func containerRootView(state *ContainerState) (string, error) {
+	data, err := ioutil.ReadFile(containerFile(state.Config.ID, "rootview.fd"))
+	if err != nil {
+		return "", fmt.Errorf("container %s has no root view, was it started by an older version? %v", shortID(state.Config.ID), err)
+	}
+
+	fd, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return "", fmt.Errorf("invalid root view of container %s: %v", shortID(state.Config.ID), err)
+	}
+	return fmt.Sprintf("/proc/%d/fd/%d", state.PID, fd), nil
+}
+
+// ExportContainer writes the container's root filesystem to w as a tar
+// stream. The pseudo filesystems, tmpfs mounts, volumes and bind mounts are
+// left out, their mount points are exported as they are in the rootfs. The
+// view is archived by an fs-helper chrooted to it, like cp.
+func ExportContainer(state *ContainerState, w io.Writer) error {
+	root, err := containerRootView(state)
+	if err != nil {
+		return err
+	}
+
+	return runFSHelper(root, nil, w, "archive", "/", ".")
+}
+
+// ImportRootFS unpacks a tar stream written by export, or any other rootfs
+// tarball, into dir, which must not exist yet or be empty
+func ImportRootFS(r io.Reader, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureEmptyDir(dir); err != nil {
+		return err
+	}
+
+	// Archive entries and links resolve inside the new rootfs, not the host
+	return extractTar(r, dir, "/", "")
+}
@@ -5,17 +5,84 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
+// generatedFiles are written by the runtime for every container and bind
+// mounted over the rootfs
+var generatedFiles = []struct {
+	name string // File name in the container's state directory
+	dest string // Path inside the container
+}{
+	{"resolv.conf", "/etc/resolv.conf"},
+	{"hosts", "/etc/hosts"},
+	{"hostname", "/etc/hostname"},
+}
+
+// maskedPaths are host-only sysfs subtrees hidden from the container:
+// firmware tables and the energy counters of powercap
+var maskedPaths = []string{
+	"/sys/firmware",
+	"/sys/devices/virtual/powercap",
+}
+
 // SetupFilesystem prepares the container's filesystem including mounts
 func SetupFilesystem(config *ContainerConfig) error {
-	// Setup bind mounts BEFORE chroot so source paths are still accessible
-	if err := setupBindMounts(config); err != nil {
-		return fmt.Errorf("failed to setup bind mounts: %v", err)
+	// Receive mounts from the host but never propagate ours back, each
+	// mount's own propagation is set when it is created
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_SLAVE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private to the container: %v", err)
+	}
+
+	// Containers with a storage size write to an overlay instead of the rootfs
+	if config.StorageSize > 0 {
+		if err := mountStorage(config); err != nil {
+			return err
+		}
+	}
+
+	// A read-only root needs a mount of its own to remount, the rootfs is
+	// usually just a directory
+	if config.ReadOnly {
+		if err := syscall.Mount(config.RootFS, config.RootFS, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind mount the rootfs: %v", err)
+		}
+	}
+
+	// Keep the root as it is before anything is mounted on it, for export
+	if err := holdRootView(config); err != nil {
+		return err
+	}
+
+	// Containers writing to their rootfs directly have no layer to diff,
+	// remember what it looked like instead
+	if config.StorageSize == 0 {
+		if err := recordBaseline(config); err != nil {
+			return err
+		}
+	}
+
+	// Populate /dev first, mounts may go inside it
+	if err := setupDev(config); err != nil {
+		return fmt.Errorf("failed to setup /dev: %v", err)
+	}
+
+	// Setup mounts BEFORE chroot so source paths are still accessible
+	if err := setupMounts(config); err != nil {
+		return fmt.Errorf("failed to setup mounts: %v", err)
+	}
+
+	// Mount the generated /etc files, leaving the ones in the rootfs untouched
+	for _, file := range generatedFiles {
+		if err := bindMountFile(containerFile(config.ID, file.name), config.RootFS, file.dest); err != nil {
+			return fmt.Errorf("failed to setup %s: %v", file.dest, err)
+		}
 	}
 
 	// Set hostname
@@ -33,21 +100,29 @@ func SetupFilesystem(config *ContainerConfig) error {
 		return fmt.Errorf("failed to change directory to /: %v", err)
 	}
 
-	// Copy resolv.conf for DNS resolution
-	if err := copyResolvConf(); err != nil {
-		return fmt.Errorf("failed to setup DNS: %v", err)
-	}
-
 	// Mount proc filesystem
 	if err := syscall.Mount("proc", "proc", "proc", 0, ""); err != nil {
 		return fmt.Errorf("failed to mount proc: %v", err)
 	}
 
+	if err := setupSysfs(config.WritableSys); err != nil {
+		return err
+	}
+
 	// Mount /dev/pts for pseudo-terminals
-	if err := syscall.Mount("devpts", "/dev/pts", "devpts", 0, ""); err != nil {
+	if err := syscall.Mount("devpts", "/dev/pts", "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"); err != nil {
 		return fmt.Errorf("failed to mount devpts: %v", err)
 	}
 
+	// With everything in place, make the rootfs read-only. The mounts on top
+	// of it, such as /dev, the tmpfs mounts and the generated /etc files,
+	// stay writable.
+	if config.ReadOnly {
+		if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("failed to make the rootfs read-only: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -55,7 +130,11 @@ func SetupFilesystem(config *ContainerConfig) error {
 func CleanupFilesystem() error {
 	var lastErr error
 
-	// Unmount in reverse order
+	// Unmount in reverse order, /sys along with everything mounted below it
+	if err := syscall.Unmount("/sys", syscall.MNT_DETACH); err != nil {
+		lastErr = err
+	}
+
 	if err := syscall.Unmount("/dev/pts", 0); err != nil {
 		lastErr = err
 	}
@@ -67,66 +146,318 @@ func CleanupFilesystem() error {
 	return lastErr
 }
 
-// setupBindMounts creates bind mounts for the container
-func setupBindMounts(config *ContainerConfig) error {
-	for _, mount := range config.Mounts {
-		if err := createBindMount(mount, config.RootFS); err != nil {
-			return fmt.Errorf("failed to create bind mount %s -> %s: %v",
-				mount.Source, mount.Destination, err)
+// setupSysfs mounts sysfs and the container's cgroup2 hierarchy, read-only
+// unless writable, and hides the maskedPaths. Runs after chroot, in the
+// container's cgroup namespace so only its own cgroup is visible.
+func setupSysfs(writable bool) error {
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if !writable {
+		flags |= syscall.MS_RDONLY
+	}
+
+	if err := syscall.Mount("sysfs", "/sys", "sysfs", flags, ""); err != nil {
+		return fmt.Errorf("failed to mount sysfs: %v", err)
+	}
+
+	if err := syscall.Mount("cgroup2", "/sys/fs/cgroup", "cgroup2", flags, ""); err != nil {
+		return fmt.Errorf("failed to mount cgroup2: %v", err)
+	}
+
+	for _, path := range maskedPaths {
+		if err := maskPath(path); err != nil {
+			return err
 		}
 	}
+
 	return nil
 }
 
-// createBindMount creates a single bind mount
+// maskPath hides a directory under an empty read-only tmpfs, or a file under
+// /dev/null
+func maskPath(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mask %s: %v", path, err)
+	}
+
+	if info.IsDir() {
+		err = syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY, "size=0")
+	} else {
+		err = syscall.Mount("/dev/null", path, "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mask %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// mountOptionFlags maps the options accepted by --mount onto mount flags
+var mountOptionFlags = map[string]uintptr{
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+	"sync":        syscall.MS_SYNCHRONOUS,
+	"dirsync":     syscall.MS_DIRSYNC,
+}
+
+// propagationFlags maps bind propagation modes onto mount flags
+var propagationFlags = map[string]uintptr{
+	"private":  syscall.MS_PRIVATE,
+	"rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"shared":   syscall.MS_SHARED,
+	"rshared":  syscall.MS_SHARED | syscall.MS_REC,
+	"slave":    syscall.MS_SLAVE,
+	"rslave":   syscall.MS_SLAVE | syscall.MS_REC,
+}
+
+// treeMountAttrs are the flags mount_setattr can apply to a whole mount tree
+var treeMountAttrs = map[uintptr]uint64{
+	syscall.MS_RDONLY: unix.MOUNT_ATTR_RDONLY,
+	syscall.MS_NOSUID: unix.MOUNT_ATTR_NOSUID,
+	syscall.MS_NODEV:  unix.MOUNT_ATTR_NODEV,
+	syscall.MS_NOEXEC: unix.MOUNT_ATTR_NOEXEC,
+}
+
+// setupMounts creates the container's bind mounts, tmpfs mounts and volumes.
+// Mounts go on before the ones below them whatever order they were given
+// in, so the tmpfs of a read-only root on /tmp doesn't hide a bind on /tmp/x.
+func setupMounts(config *ContainerConfig) error {
+	mounts := append([]Mount(nil), config.Mounts...)
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return mountDepth(mounts[i]) < mountDepth(mounts[j])
+	})
+
+	for _, mount := range mounts {
+		if err := createMount(mount, config.RootFS); err != nil {
+			return fmt.Errorf("failed to mount %s on %s: %v", mount.mountType(), mount.Destination, err)
+		}
+	}
+	return nil
+}
+
+// mountDepth returns how many directories deep the mount's destination is
+func mountDepth(mount Mount) int {
+	dest := filepath.Clean(mount.Destination)
+	if dest == "/" {
+		return 0
+	}
+	return strings.Count(dest, "/")
+}
+
+// createMount creates a single mount, volumes are bind mounts of their data directory
+func createMount(mount Mount, rootFS string) error {
+	switch mount.mountType() {
+	case mountTmpfs:
+		return createTmpfsMount(mount, rootFS)
+	case mountVolume:
+		mount.Source = volumePath(mount.Source)
+	}
+	return createBindMount(mount, rootFS)
+}
+
+// mountFlags returns the flags of the mount's options
+func mountFlags(mount Mount) uintptr {
+	var flags uintptr
+	if mount.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	for _, opt := range mount.Options {
+		flags |= mountOptionFlags[opt]
+	}
+	return flags
+}
+
+// createBindMount creates a single bind mount, including the mounts below
+// the source unless it is non-recursive
 func createBindMount(mount Mount, rootFS string) error {
 	// Verify source exists
-	if _, err := os.Stat(mount.Source); os.IsNotExist(err) {
+	info, err := os.Stat(mount.Source)
+	if os.IsNotExist(err) {
 		return fmt.Errorf("source path does not exist: %s", mount.Source)
 	}
+	if err != nil {
+		return err
+	}
 
 	// Create the mount point in the rootFS
-	mountPoint := filepath.Join(rootFS, mount.Destination)
-	if err := os.MkdirAll(mountPoint, 0755); err != nil {
-		return fmt.Errorf("failed to create mount point %s: %v", mountPoint, err)
+	mountPoint, err := createMountPoint(rootFS, mount.Destination, info.IsDir())
+	if err != nil {
+		return err
 	}
 
-	// Determine mount flags
+	// Create the bind mount, idmapped ones through the new mount API
 	flags := uintptr(syscall.MS_BIND)
-	if mount.ReadOnly {
-		flags |= syscall.MS_RDONLY
+	if !mount.NonRecursive {
+		flags |= syscall.MS_REC
 	}
-
-	// Create the bind mount
-	if err := syscall.Mount(mount.Source, mountPoint, "", flags, ""); err != nil {
+	if len(mount.IDMap) > 0 {
+		if err := createIDMappedBind(mount, mountPoint); err != nil {
+			return err
+		}
+	} else if err := syscall.Mount(mount.Source, mountPoint, "", flags, ""); err != nil {
 		return fmt.Errorf("failed to bind mount: %v", err)
 	}
 
-	// If read-only, remount with MS_RDONLY (required for bind mounts)
-	if mount.ReadOnly {
-		remountFlags := flags | syscall.MS_REMOUNT
-		if err := syscall.Mount("", mountPoint, "", remountFlags, ""); err != nil {
-			return fmt.Errorf("failed to remount as read-only: %v", err)
+	// Bind mounts ignore other flags, they only apply when remounting
+	if extra := mountFlags(mount); extra != 0 {
+		if err := syscall.Mount("", mountPoint, "", syscall.MS_BIND|syscall.MS_REMOUNT|extra, ""); err != nil {
+			return fmt.Errorf("failed to remount with options: %v", err)
+		}
+		if !mount.NonRecursive {
+			if err := setMountTreeAttrs(mountPoint, extra); err != nil {
+				return fmt.Errorf("failed to apply options to submounts: %v", err)
+			}
 		}
 	}
 
+	// Like Docker, binds don't propagate mounts unless asked to
+	propagation := mount.Propagation
+	if propagation == "" {
+		propagation = "rprivate"
+	}
+	if err := syscall.Mount("", mountPoint, "", propagationFlags[propagation], ""); err != nil {
+		return fmt.Errorf("failed to set propagation to %s: %v", propagation, err)
+	}
+
+	return nil
+}
+
+// setMountTreeAttrs applies the read-only, nosuid, nodev and noexec flags to
+// the mounts below a recursive bind as well, which remounting doesn't reach
+func setMountTreeAttrs(mountPoint string, flags uintptr) error {
+	attr := &unix.MountAttr{}
+	for flag, mountAttr := range treeMountAttrs {
+		if flags&flag != 0 {
+			attr.Attr_set |= mountAttr
+		}
+	}
+	if attr.Attr_set == 0 {
+		return nil
+	}
+
+	err := unix.MountSetattr(unix.AT_FDCWD, mountPoint, unix.AT_RECURSIVE, attr)
+	if err == unix.ENOSYS {
+		logDebug("mount_setattr is not supported, mounts below %s keep their flags", mountPoint)
+		return nil
+	}
+	return err
+}
+
+// createTmpfsMount mounts a new tmpfs in the container
+func createTmpfsMount(mount Mount, rootFS string) error {
+	mountPoint, err := createMountPoint(rootFS, mount.Destination, true)
+	if err != nil {
+		return err
+	}
+
+	mode := mount.TmpfsMode
+	if mode == 0 {
+		mode = 01777
+	}
+	data := fmt.Sprintf("mode=%o", mode)
+	if mount.TmpfsSize != "" {
+		data += ",size=" + mount.TmpfsSize
+	}
+
+	if err := syscall.Mount("tmpfs", mountPoint, "tmpfs", mountFlags(mount), data); err != nil {
+		return fmt.Errorf("failed to mount tmpfs: %v", err)
+	}
+
 	return nil
 }
 
-// copyResolvConf sets up DNS resolution in the container, in this case 8.8.8.8 google's dns
-func copyResolvConf() error {
-	if err := os.MkdirAll("/etc", 0755); err != nil {
-		return fmt.Errorf("failed to create /etc directory: %v", err)
+// createMountPoint creates the directory or empty file to mount over at dest
+// in the container, resolving dest the way the container will see it
+func createMountPoint(rootFS, dest string, dir bool) (string, error) {
+	target, err := resolveInRoot(rootFS, dest)
+	if err != nil {
+		return "", err
+	}
+
+	if dir {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return "", fmt.Errorf("failed to create mount point %s: %v", dest, err)
+		}
+		return target, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for %s: %v", dest, err)
 	}
 
-	content := []byte("nameserver 8.8.8.8\nnameserver 8.8.4.4\n")
-	if err := ioutil.WriteFile("/etc/resolv.conf", content, 0644); err != nil {
-		return fmt.Errorf("failed to write resolv.conf: %v", err)
+	if !fileExists(target) {
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return "", fmt.Errorf("failed to create %s: %v", dest, err)
+		}
+		file.Close()
+	}
+
+	return target, nil
+}
+
+// bindMountFile bind mounts a single file from the host over a path in the
+// container, creating an empty file to mount over if the path doesn't exist
+func bindMountFile(source, rootFS, dest string) error {
+	target, err := createMountPoint(rootFS, dest, false)
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s: %v", dest, err)
 	}
 
 	return nil
 }
 
+// resolveInRoot resolves path inside rootFS the way the container will see it
+// after chroot, so symlinks in the rootfs can't point at files on the host
+func resolveInRoot(rootFS, path string) (string, error) {
+	const maxSymlinks = 40
+
+	resolved := "/"
+	remaining := strings.Split(path, "/")
+	for links := 0; len(remaining) > 0; {
+		part := remaining[0]
+		remaining = remaining[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		target, err := os.Readlink(filepath.Join(rootFS, next))
+		if err != nil {
+			// Not a symlink, or doesn't exist yet
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+
+	return filepath.Join(rootFS, resolved), nil
+}
+
 // PrepareRootFS ensures the root filesystem directory exists and is properly set up
 func PrepareRootFS(rootfsPath string) error {
 	// Check if rootfs exists
@@ -137,9 +468,9 @@ func PrepareRootFS(rootfsPath string) error {
 	// Ensure required directories exist in the rootfs
 	requiredDirs := []string{
 		filepath.Join(rootfsPath, "proc"), // Required for proc filesystem, else ps command will not work
-		filepath.Join(rootfsPath, "dev"),
-		filepath.Join(rootfsPath, "dev/pts"), // Required for pseudo-terminals, else ls -l /dev/pts will not work
-		filepath.Join(rootfsPath, "etc"),     // Required for DNS resolution, else ping google.com will not work
+		filepath.Join(rootfsPath, "sys"),  // sysfs and the container's cgroups are mounted here
+		filepath.Join(rootfsPath, "dev"),  // A tmpfs with the device nodes is mounted here
+		filepath.Join(rootfsPath, "etc"),  // Required for DNS resolution, else ping google.com will not work
 		filepath.Join(rootfsPath, "app"),
 		filepath.Join(rootfsPath, "tmp"),
 	}
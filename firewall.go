@@ -0,0 +1,145 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Chains a FirewallRule can be placed in. Each backend maps them onto its own
+// hooks (nftables) or built-in chains (iptables).
+const (
+	chainPrerouting  = "prerouting"
+	chainOutput      = "output"
+	chainPostrouting = "postrouting"
+	chainForward     = "forward"
+	chainInput       = "input"
+)
+
+// Actions a FirewallRule can take once it matches
+const (
+	actionAccept     = "accept"
+	actionDrop       = "drop"
+	actionMasquerade = "masquerade"
+	actionDNAT       = "dnat"
+	actionReturn     = "return" // Stop at this owner's rules, leaving the verdict to other owners
+	actionLog        = "log"    // Log to the kernel log and carry on with the next rule
+)
+
+// logRate caps how many packets per second a single actionLog rule logs
+const logRate = 10
+
+// FirewallRule is a backend independent description of a single rule. Empty
+// fields don't take part in matching.
+type FirewallRule struct {
+	Chain       string
+	Proto       string // tcp, udp or icmpv6
+	Src         string // Address or CIDR
+	Dst         string // Address or CIDR
+	DstLocal    bool   // Destination is any address of the host
+	InIface     string // Interface name, a trailing "+" matches a prefix, a leading "!" negates
+	OutIface    string // Same format as InIface
+	DPort       int    // Destination port, requires Proto
+	Action      string
+	ToAddr      string // DNAT target address
+	ToPort      int    // DNAT target port
+	Established bool   // Only match packets of established or related connections
+	LogPrefix   string // Prefix of actionLog messages
+}
+
+// ipFamily returns 4 or 6 when the rule's addresses tie it to an IP version,
+// or 0 when it applies to both
+func (r FirewallRule) ipFamily() (int, error) {
+	family := 0
+	for _, addr := range []string{r.Src, r.Dst, r.ToAddr} {
+		if addr == "" {
+			continue
+		}
+
+		ip, _, err := parseAddrOrCIDR(addr)
+		if err != nil {
+			return 0, err
+		}
+
+		addrFamily := 6
+		if ip.To4() != nil {
+			addrFamily = 4
+		}
+		if family != 0 && family != addrFamily {
+			return 0, fmt.Errorf("rule mixes IPv4 and IPv6 addresses")
+		}
+		family = addrFamily
+	}
+	return family, nil
+}
+
+// Firewall installs rules on the host. Rules are grouped by owner (a container
+// or a network), and each owner's rules are kept apart from everyone else's so
+// removing them can never touch rules belonging to another owner.
+type Firewall interface {
+	// Name identifies the backend in log messages
+	Name() string
+	// Apply replaces every rule held by owner with rules
+	Apply(owner string, rules []FirewallRule) error
+	// Remove deletes every rule held by owner
+	Remove(owner string) error
+}
+
+// networkOwner is the firewall owner for rules shared by a network
+func networkOwner(network *Network) string {
+	return "n-" + shortID(network.ID)
+}
+
+// containerOwner is the firewall owner for rules belonging to a single container
+func containerOwner(config *ContainerConfig) string {
+	return "c-" + shortID(config.ID)
+}
+
+// NewFirewall returns the firewall backend to use. FIREWALL_BACKEND can be set
+// to "nftables" or "iptables", otherwise nftables is preferred when the kernel
+// supports it and no other table drops forwarded packets, and iptables is used
+// as a fallback.
+func NewFirewall() (Firewall, error) {
+	switch backend := os.Getenv("FIREWALL_BACKEND"); backend {
+	case "nftables":
+		if err := nftablesAvailable(); err != nil {
+			return nil, fmt.Errorf("nftables backend unavailable: %v", err)
+		}
+		if chain, _ := nftablesForwardDrop(); chain != "" {
+			logError("Chain %s drops forwarded packets, container traffic is dropped even though nftables accepts it", chain)
+		}
+		return &nftablesFirewall{}, nil
+	case "iptables":
+		return &iptablesFirewall{}, nil
+	case "":
+	default:
+		return nil, fmt.Errorf("unknown FIREWALL_BACKEND %q, expected nftables or iptables", backend)
+	}
+
+	// An accept in our own tables doesn't override another table's drop
+	// policy, a rule in that chain does, which is what iptables adds
+	err := nftablesAvailable()
+	dropChain := ""
+	if err == nil {
+		if dropChain, err = nftablesForwardDrop(); err == nil && dropChain == "" {
+			return &nftablesFirewall{}, nil
+		}
+	}
+	if dropChain != "" {
+		logDebug("Chain %s drops forwarded packets, falling back to iptables", dropChain)
+	} else {
+		logDebug("nftables unavailable, falling back to iptables: %v", err)
+	}
+
+	if _, err := exec.LookPath("iptables"); err != nil {
+		if dropChain != "" {
+			logError("Chain %s drops forwarded packets and iptables isn't available, container traffic may be dropped", dropChain)
+			return &nftablesFirewall{}, nil
+		}
+		return nil, fmt.Errorf("neither nftables nor the iptables binary is available")
+	}
+	return &iptablesFirewall{}, nil
+}
@@ -0,0 +1,240 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// iptablesChain describes where a FirewallRule chain lives in iptables
+type iptablesChain struct {
+	table   string
+	builtin string
+	suffix  string
+}
+
+// iptablesChains maps FirewallRule chains onto iptables tables and built-in chains
+var iptablesChains = map[string]iptablesChain{
+	chainPrerouting:  {"nat", "PREROUTING", "PRE"},
+	chainOutput:      {"nat", "OUTPUT", "OUT"},
+	chainPostrouting: {"nat", "POSTROUTING", "POST"},
+	chainForward:     {"filter", "FORWARD", "FWD"},
+	chainInput:       {"filter", "INPUT", "IN"},
+}
+
+// iptablesChainOrder fixes the order chains are processed in, so output is stable
+var iptablesChainOrder = []string{chainPrerouting, chainOutput, chainPostrouting, chainForward, chainInput}
+
+// iptablesBinaries maps an IP version onto the binary managing its rules
+var iptablesBinaries = map[int]string{4: "iptables", 6: "ip6tables"}
+
+// iptablesFirewall shells out to the iptables and ip6tables binaries. Every
+// owner gets its own chain per built-in chain, jumped to from the built-in
+// chain, so an owner's rules can be flushed without looking at anyone else's.
+type iptablesFirewall struct{}
+
+func (f *iptablesFirewall) Name() string {
+	return "iptables"
+}
+
+// chainName returns the owner's chain hooked into the given built-in chain
+func (f *iptablesFirewall) chainName(owner string, chain iptablesChain) string {
+	return fmt.Sprintf("NSC-%s-%s", owner, chain.suffix)
+}
+
+func (f *iptablesFirewall) Apply(owner string, rules []FirewallRule) error {
+	// Rules without addresses apply to both IP versions
+	byFamily := map[int][]FirewallRule{4: nil, 6: nil}
+	for _, rule := range rules {
+		family, err := rule.ipFamily()
+		if err != nil {
+			return err
+		}
+
+		if family != 6 {
+			byFamily[4] = append(byFamily[4], rule)
+		}
+		if family != 4 {
+			byFamily[6] = append(byFamily[6], rule)
+		}
+	}
+
+	for _, family := range []int{4, 6} {
+		binary := iptablesBinaries[family]
+		if _, err := exec.LookPath(binary); err != nil {
+			if family == 6 && !hasIPv6Rule(rules) {
+				logDebug("%s not found, skipping IPv6 rules", binary)
+				continue
+			}
+			return fmt.Errorf("%s is required: %v", binary, err)
+		}
+
+		if err := f.apply(binary, owner, byFamily[family]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// apply installs the owner's rules with a single binary
+func (f *iptablesFirewall) apply(binary, owner string, rules []FirewallRule) error {
+	byChain := make(map[string][][]string)
+	for _, rule := range rules {
+		if _, ok := iptablesChains[rule.Chain]; !ok {
+			return fmt.Errorf("unknown chain %q", rule.Chain)
+		}
+
+		spec, err := iptablesRuleSpec(rule)
+		if err != nil {
+			return err
+		}
+		byChain[rule.Chain] = append(byChain[rule.Chain], spec)
+	}
+
+	for _, name := range iptablesChainOrder {
+		chain := iptablesChains[name]
+		ownChain := f.chainName(owner, chain)
+
+		specs, used := byChain[name]
+		if !used {
+			f.removeChain(binary, chain, ownChain)
+			continue
+		}
+
+		// Create the chain, or empty it if a previous Apply left rules behind
+		if f.run(binary, chain.table, "-N", ownChain) != nil {
+			if err := f.run(binary, chain.table, "-F", ownChain); err != nil {
+				return err
+			}
+		}
+
+		for _, spec := range specs {
+			if err := f.run(binary, chain.table, append([]string{"-A", ownChain}, spec...)...); err != nil {
+				return err
+			}
+		}
+
+		// Jump to our chain first, keeping the jump's position if it already exists
+		if f.run(binary, chain.table, "-C", chain.builtin, "-j", ownChain) != nil {
+			if err := f.run(binary, chain.table, "-I", chain.builtin, "1", "-j", ownChain); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *iptablesFirewall) Remove(owner string) error {
+	for _, family := range []int{4, 6} {
+		binary := iptablesBinaries[family]
+		if _, err := exec.LookPath(binary); err != nil {
+			continue
+		}
+
+		for _, name := range iptablesChainOrder {
+			chain := iptablesChains[name]
+			f.removeChain(binary, chain, f.chainName(owner, chain))
+		}
+	}
+	return nil
+}
+
+// removeChain unhooks, flushes and deletes one of our chains if it exists
+func (f *iptablesFirewall) removeChain(binary string, chain iptablesChain, ownChain string) {
+	// Delete every jump, in case one was added more than once
+	for {
+		if err := f.run(binary, chain.table, "-D", chain.builtin, "-j", ownChain); err != nil {
+			break
+		}
+	}
+	f.run(binary, chain.table, "-F", ownChain)
+	f.run(binary, chain.table, "-X", ownChain)
+}
+
+// run executes iptables or ip6tables against a table, including its stderr in the error
+func (f *iptablesFirewall) run(binary, table string, args ...string) error {
+	args = append([]string{"-w", "-t", table}, args...)
+	if out, err := exec.Command(binary, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", binary, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// hasIPv6Rule reports whether any rule is tied to IPv6 addresses
+func hasIPv6Rule(rules []FirewallRule) bool {
+	for _, rule := range rules {
+		if family, _ := rule.ipFamily(); family == 6 {
+			return true
+		}
+	}
+	return false
+}
+
+// iptablesRuleSpec converts a FirewallRule into iptables match and target arguments
+func iptablesRuleSpec(rule FirewallRule) ([]string, error) {
+	var spec []string
+
+	if rule.Proto != "" {
+		spec = append(spec, "-p", rule.Proto)
+	}
+	if rule.Src != "" {
+		spec = append(spec, "-s", rule.Src)
+	}
+	if rule.Dst != "" {
+		spec = append(spec, "-d", rule.Dst)
+	}
+	if rule.DstLocal {
+		spec = append(spec, "-m", "addrtype", "--dst-type", "LOCAL")
+	}
+	if rule.InIface != "" {
+		spec = append(spec, iptablesIfaceMatch("-i", rule.InIface)...)
+	}
+	if rule.OutIface != "" {
+		spec = append(spec, iptablesIfaceMatch("-o", rule.OutIface)...)
+	}
+	if rule.DPort != 0 {
+		if rule.Proto == "" {
+			return nil, fmt.Errorf("destination port %d requires a protocol", rule.DPort)
+		}
+		spec = append(spec, "--dport", strconv.Itoa(rule.DPort))
+	}
+	if rule.Established {
+		spec = append(spec, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED")
+	}
+
+	switch rule.Action {
+	case actionAccept:
+		spec = append(spec, "-j", "ACCEPT")
+	case actionDrop:
+		spec = append(spec, "-j", "DROP")
+	case actionMasquerade:
+		spec = append(spec, "-j", "MASQUERADE")
+	case actionDNAT:
+		spec = append(spec, "-j", "DNAT", "--to-destination",
+			net.JoinHostPort(rule.ToAddr, strconv.Itoa(rule.ToPort)))
+	case actionReturn:
+		spec = append(spec, "-j", "RETURN")
+	case actionLog:
+		spec = append(spec, "-m", "limit", "--limit", fmt.Sprintf("%d/second", logRate),
+			"-j", "LOG", "--log-prefix", rule.LogPrefix)
+	default:
+		return nil, fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	return spec, nil
+}
+
+// iptablesIfaceMatch converts an interface match into iptables arguments
+func iptablesIfaceMatch(flag, iface string) []string {
+	if strings.HasPrefix(iface, "!") {
+		return []string{"!", flag, iface[1:]}
+	}
+	return []string{flag, iface}
+}
@@ -0,0 +1,699 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Verdict codes from linux/netfilter.h
+const (
+	nfDrop   = 0
+	nfAccept = 1
+	nfReturn = 0xfffffffb // NFT_RETURN, -5 as an unsigned value
+)
+
+// Conntrack state bits from linux/netfilter/nf_conntrack_common.h
+const (
+	ctStateEstablished = 1 << 1
+	ctStateRelated     = 1 << 2
+)
+
+// nftablesChain describes the base chain a FirewallRule chain maps onto
+type nftablesChain struct {
+	chainType string
+	hook      uint32
+	priority  int32
+}
+
+// nftablesChains maps FirewallRule chains onto nftables base chains, using the
+// same priorities as the iptables nat and filter tables
+var nftablesChains = map[string]nftablesChain{
+	chainPrerouting:  {"nat", unix.NF_INET_PRE_ROUTING, -100},
+	chainOutput:      {"nat", unix.NF_INET_LOCAL_OUT, -100},
+	chainPostrouting: {"nat", unix.NF_INET_POST_ROUTING, 100},
+	chainForward:     {"filter", unix.NF_INET_FORWARD, 0},
+	chainInput:       {"filter", unix.NF_INET_LOCAL_IN, 0},
+}
+
+// nftablesFirewall talks to nf_tables directly over netlink. Every owner gets
+// its own inet table, so applying or removing an owner's rules is a single
+// atomic transaction that can't touch another owner's table.
+type nftablesFirewall struct{}
+
+func (f *nftablesFirewall) Name() string {
+	return "nftables"
+}
+
+// tableName returns the nftables table holding the owner's rules
+func (f *nftablesFirewall) tableName(owner string) string {
+	return "nsc-" + owner
+}
+
+func (f *nftablesFirewall) Apply(owner string, rules []FirewallRule) error {
+	table := f.tableName(owner)
+
+	// Adding the table before deleting it makes the delete safe when the table
+	// doesn't exist yet, and replaces an existing table in the same transaction
+	batch := []nftMessage{
+		newTableMsg(table),
+		delTableMsg(table),
+		newTableMsg(table),
+	}
+
+	created := make(map[string]bool)
+	for _, rule := range rules {
+		chain, ok := nftablesChains[rule.Chain]
+		if !ok {
+			return fmt.Errorf("unknown chain %q", rule.Chain)
+		}
+
+		if !created[rule.Chain] {
+			batch = append(batch, newChainMsg(table, rule.Chain, chain))
+			created[rule.Chain] = true
+		}
+
+		exprs, err := nftRuleExprs(rule)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, newRuleMsg(table, rule.Chain, exprs))
+	}
+
+	return sendNftBatch(batch)
+}
+
+func (f *nftablesFirewall) Remove(owner string) error {
+	table := f.tableName(owner)
+	return sendNftBatch([]nftMessage{newTableMsg(table), delTableMsg(table)})
+}
+
+// nftablesAvailable checks that the kernel answers nf_tables requests
+func nftablesAvailable() error {
+	sock, err := nl.Subscribe(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("failed to open netfilter socket: %v", err)
+	}
+	defer sock.Close()
+
+	if err := sock.SetReceiveTimeout(&unix.Timeval{Sec: 2}); err != nil {
+		return err
+	}
+
+	msg := nftMessage{msgType: unix.NFT_MSG_GETTABLE, flags: unix.NLM_F_DUMP}
+	if err := unix.Sendto(sock.GetFd(), msg.encode(1), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to query nftables: %v", err)
+	}
+
+	for {
+		msgs, _, err := sock.Receive()
+		if err != nil {
+			return fmt.Errorf("failed to query nftables: %v", err)
+		}
+
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return nil
+			case unix.NLMSG_ERROR:
+				if errno := nlmsgErrno(m); errno != 0 {
+					return errno
+				}
+				return nil
+			}
+		}
+	}
+}
+
+// nftablesForwardDrop returns the first forward base chain of another table
+// whose policy drops packets, such as the FORWARD chain Docker and firewalld
+// set to drop. A packet must be accepted by every table's chains, so such a
+// chain drops container traffic whatever our own tables accept.
+func nftablesForwardDrop() (string, error) {
+	sock, err := nl.Subscribe(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return "", fmt.Errorf("failed to open netfilter socket: %v", err)
+	}
+	defer sock.Close()
+
+	if err := sock.SetReceiveTimeout(&unix.Timeval{Sec: 2}); err != nil {
+		return "", err
+	}
+
+	// Dump the chains of every family, iptables-nft uses the ip and ip6 ones
+	req := encodeNfnlMsg(unix.NFNL_SUBSYS_NFTABLES<<8|unix.NFT_MSG_GETCHAIN,
+		unix.NLM_F_REQUEST|unix.NLM_F_DUMP, 1, unix.NFPROTO_UNSPEC, 0, nil)
+	if err := unix.Sendto(sock.GetFd(), req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return "", fmt.Errorf("failed to list nftables chains: %v", err)
+	}
+
+	found := ""
+	for {
+		msgs, _, err := sock.Receive()
+		if err != nil {
+			return "", fmt.Errorf("failed to list nftables chains: %v", err)
+		}
+
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return found, nil
+			case unix.NLMSG_ERROR:
+				if errno := nlmsgErrno(m); errno != 0 {
+					return "", errno
+				}
+				return found, nil
+			}
+			if found == "" && len(m.Data) > 4 {
+				found = forwardDropChain(m.Data[0], m.Data[4:])
+			}
+		}
+	}
+}
+
+// forwardDropChain returns "family table chain" when the dumped chain is an
+// IP forward base chain with a drop policy outside our own tables
+func forwardDropChain(family byte, data []byte) string {
+	families := map[byte]string{unix.NFPROTO_IPV4: "ip", unix.NFPROTO_IPV6: "ip6", unix.NFPROTO_INET: "inet"}
+	if families[family] == "" {
+		return ""
+	}
+
+	attrs, err := nl.ParseRouteAttr(data)
+	if err != nil {
+		return ""
+	}
+
+	var table, name string
+	hooked, drops := false, false
+	for _, attr := range attrs {
+		switch attr.Attr.Type &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER) {
+		case unix.NFTA_CHAIN_TABLE:
+			table = strings.TrimRight(string(attr.Value), "\x00")
+		case unix.NFTA_CHAIN_NAME:
+			name = strings.TrimRight(string(attr.Value), "\x00")
+		case unix.NFTA_CHAIN_POLICY:
+			drops = len(attr.Value) == 4 && binary.BigEndian.Uint32(attr.Value) == nfDrop
+		case unix.NFTA_CHAIN_HOOK:
+			hook, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				continue
+			}
+			for _, h := range hook {
+				if h.Attr.Type&^(unix.NLA_F_NESTED|unix.NLA_F_NET_BYTEORDER) == unix.NFTA_HOOK_HOOKNUM && len(h.Value) == 4 {
+					hooked = binary.BigEndian.Uint32(h.Value) == unix.NF_INET_FORWARD
+				}
+			}
+		}
+	}
+
+	if !hooked || !drops || strings.HasPrefix(table, "nsc-") {
+		return ""
+	}
+	return fmt.Sprintf("%s %s %s", families[family], table, name)
+}
+
+// nftMessage is a single nf_tables request inside a batch
+type nftMessage struct {
+	msgType uint16
+	flags   uint16
+	attrs   nlAttrs
+}
+
+// encode serializes the message as an inet family nf_tables netlink message
+func (m nftMessage) encode(seq uint32) []byte {
+	return encodeNfnlMsg(unix.NFNL_SUBSYS_NFTABLES<<8|m.msgType,
+		unix.NLM_F_REQUEST|m.flags, seq, unix.NFPROTO_INET, 0, m.attrs)
+}
+
+// encodeNfnlMsg builds a netlink header, nfgenmsg header and attributes
+func encodeNfnlMsg(msgType, flags uint16, seq uint32, family uint8, resID uint16, attrs []byte) []byte {
+	length := unix.SizeofNlMsghdr + 4 + len(attrs)
+	buf := make([]byte, length)
+
+	native := nl.NativeEndian()
+	native.PutUint32(buf[0:4], uint32(length))
+	native.PutUint16(buf[4:6], msgType)
+	native.PutUint16(buf[6:8], flags)
+	native.PutUint32(buf[8:12], seq)
+
+	// struct nfgenmsg: family, version and the big endian resource ID
+	buf[16] = family
+	buf[17] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(buf[18:20], resID)
+
+	copy(buf[20:], attrs)
+	return buf
+}
+
+// sendNftBatch submits the messages as one transaction, so either all of them
+// take effect or none do
+func sendNftBatch(msgs []nftMessage) error {
+	sock, err := nl.Subscribe(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("failed to open netfilter socket: %v", err)
+	}
+	defer sock.Close()
+
+	if err := sock.SetReceiveTimeout(&unix.Timeval{Sec: 2}); err != nil {
+		return err
+	}
+
+	seq := uint32(1)
+	buf := encodeNfnlMsg(unix.NFNL_MSG_BATCH_BEGIN, unix.NLM_F_REQUEST, seq,
+		unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES, nil)
+	for _, msg := range msgs {
+		seq++
+		msg.flags |= unix.NLM_F_ACK
+		buf = append(buf, msg.encode(seq)...)
+	}
+	seq++
+	buf = append(buf, encodeNfnlMsg(unix.NFNL_MSG_BATCH_END, unix.NLM_F_REQUEST, seq,
+		unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES, nil)...)
+
+	if err := unix.Sendto(sock.GetFd(), buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to send nftables batch: %v", err)
+	}
+
+	// Every message asked for an acknowledgement; wait for all of them so the
+	// first error can be reported
+	var firstErr error
+	for pending := len(msgs); pending > 0; {
+		replies, _, err := sock.Receive()
+		if err != nil {
+			if firstErr != nil {
+				break
+			}
+			return fmt.Errorf("failed to read nftables reply: %v", err)
+		}
+
+		for _, m := range replies {
+			if m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			pending--
+			if errno := nlmsgErrno(m); errno != 0 && firstErr == nil {
+				firstErr = fmt.Errorf("nftables request %d failed: %v", m.Header.Seq-1, errno)
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// nlmsgErrno extracts the error code from an NLMSG_ERROR message
+func nlmsgErrno(m syscall.NetlinkMessage) syscall.Errno {
+	if len(m.Data) < 4 {
+		return 0
+	}
+	return syscall.Errno(-int32(nl.NativeEndian().Uint32(m.Data[0:4])))
+}
+
+func newTableMsg(table string) nftMessage {
+	var attrs nlAttrs
+	attrs.addString(unix.NFTA_TABLE_NAME, table)
+	return nftMessage{msgType: unix.NFT_MSG_NEWTABLE, flags: unix.NLM_F_CREATE, attrs: attrs}
+}
+
+func delTableMsg(table string) nftMessage {
+	var attrs nlAttrs
+	attrs.addString(unix.NFTA_TABLE_NAME, table)
+	return nftMessage{msgType: unix.NFT_MSG_DELTABLE, attrs: attrs}
+}
+
+func newChainMsg(table, name string, chain nftablesChain) nftMessage {
+	var hook nlAttrs
+	hook.addU32(unix.NFTA_HOOK_HOOKNUM, chain.hook)
+	hook.addU32(unix.NFTA_HOOK_PRIORITY, uint32(chain.priority))
+
+	var attrs nlAttrs
+	attrs.addString(unix.NFTA_CHAIN_TABLE, table)
+	attrs.addString(unix.NFTA_CHAIN_NAME, name)
+	attrs.addNested(unix.NFTA_CHAIN_HOOK, hook)
+	attrs.addU32(unix.NFTA_CHAIN_POLICY, nfAccept)
+	attrs.addString(unix.NFTA_CHAIN_TYPE, chain.chainType)
+	return nftMessage{msgType: unix.NFT_MSG_NEWCHAIN, flags: unix.NLM_F_CREATE, attrs: attrs}
+}
+
+func newRuleMsg(table, chain string, exprs nlAttrs) nftMessage {
+	var attrs nlAttrs
+	attrs.addString(unix.NFTA_RULE_TABLE, table)
+	attrs.addString(unix.NFTA_RULE_CHAIN, chain)
+	attrs.addNested(unix.NFTA_RULE_EXPRESSIONS, exprs)
+	return nftMessage{msgType: unix.NFT_MSG_NEWRULE, flags: unix.NLM_F_CREATE | unix.NLM_F_APPEND, attrs: attrs}
+}
+
+// nftRuleExprs compiles a FirewallRule into nf_tables expressions. Matches load
+// a value into register 1 and compare it; the action comes last.
+func nftRuleExprs(rule FirewallRule) (nlAttrs, error) {
+	var exprs nlAttrs
+
+	family, err := rule.ipFamily()
+	if err != nil {
+		return nil, err
+	}
+
+	// Rules with addresses only look at packets of the matching IP version.
+	// Offsets are those of the source and destination address in the header.
+	nfproto, srcOffset, dstOffset := uint32(unix.NFPROTO_IPV4), uint32(12), uint32(16)
+	if family == 6 {
+		nfproto, srcOffset, dstOffset = unix.NFPROTO_IPV6, 8, 24
+	}
+	if family != 0 {
+		exprs.add(exprMeta(unix.NFT_META_NFPROTO, unix.NFT_REG_1))
+		exprs.add(exprCmp(unix.NFT_CMP_EQ, unix.NFT_REG_1, []byte{byte(nfproto)}))
+	}
+
+	if rule.Proto != "" {
+		proto, err := protoNumber(rule.Proto)
+		if err != nil {
+			return nil, err
+		}
+		exprs.add(exprMeta(unix.NFT_META_L4PROTO, unix.NFT_REG_1))
+		exprs.add(exprCmp(unix.NFT_CMP_EQ, unix.NFT_REG_1, []byte{proto}))
+	}
+
+	if rule.Src != "" {
+		if err := exprs.addAddrMatch(srcOffset, rule.Src); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Dst != "" {
+		if err := exprs.addAddrMatch(dstOffset, rule.Dst); err != nil {
+			return nil, err
+		}
+	}
+
+	if rule.DstLocal {
+		exprs.add(exprFibDaddrType(unix.NFT_REG_1))
+		local := make([]byte, 4)
+		nl.NativeEndian().PutUint32(local, unix.RTN_LOCAL)
+		exprs.add(exprCmp(unix.NFT_CMP_EQ, unix.NFT_REG_1, local))
+	}
+
+	if rule.InIface != "" {
+		exprs.addIfaceMatch(unix.NFT_META_IIFNAME, rule.InIface)
+	}
+	if rule.OutIface != "" {
+		exprs.addIfaceMatch(unix.NFT_META_OIFNAME, rule.OutIface)
+	}
+
+	if rule.DPort != 0 {
+		if rule.Proto == "" {
+			return nil, fmt.Errorf("destination port %d requires a protocol", rule.DPort)
+		}
+		exprs.add(exprPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, 2, 2, unix.NFT_REG_1))
+		exprs.add(exprCmp(unix.NFT_CMP_EQ, unix.NFT_REG_1, be16(uint16(rule.DPort))))
+	}
+
+	if rule.Established {
+		// The state is a bitmask in host byte order
+		mask := make([]byte, 4)
+		nl.NativeEndian().PutUint32(mask, ctStateEstablished|ctStateRelated)
+		exprs.add(exprCt(unix.NFT_CT_STATE, unix.NFT_REG_1))
+		exprs.add(exprBitwise(unix.NFT_REG_1, mask))
+		exprs.add(exprCmp(unix.NFT_CMP_NEQ, unix.NFT_REG_1, make([]byte, 4)))
+	}
+
+	switch rule.Action {
+	case actionAccept:
+		exprs.add(exprVerdict(nfAccept))
+	case actionDrop:
+		exprs.add(exprVerdict(nfDrop))
+	case actionMasquerade:
+		exprs.add(nftExpr("masq", nil))
+	case actionDNAT:
+		addr := net.ParseIP(rule.ToAddr)
+		if addr == nil {
+			return nil, fmt.Errorf("invalid DNAT address %q", rule.ToAddr)
+		}
+		if family == 4 {
+			addr = addr.To4()
+		}
+		exprs.add(exprImmediate(unix.NFT_REG_1, addr))
+		exprs.add(exprImmediate(unix.NFT_REG_2, be16(uint16(rule.ToPort))))
+		exprs.add(exprDNAT(nfproto, unix.NFT_REG_1, unix.NFT_REG_2))
+	case actionReturn:
+		exprs.add(exprVerdict(nfReturn))
+	case actionLog:
+		exprs.add(exprLimit(logRate))
+		exprs.add(exprLog(rule.LogPrefix))
+	default:
+		return nil, fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	return exprs, nil
+}
+
+// addAddrMatch matches an address or CIDR at the given network header offset
+func (a *nlAttrs) addAddrMatch(offset uint32, addr string) error {
+	ip, ipNet, err := parseAddrOrCIDR(addr)
+	if err != nil {
+		return err
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	network := ipNet.IP
+	if ip4 := network.To4(); ip4 != nil {
+		network = ip4
+	}
+
+	a.add(exprPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, offset, uint32(len(ip)), unix.NFT_REG_1))
+	if ones, bits := ipNet.Mask.Size(); ones != bits {
+		a.add(exprBitwise(unix.NFT_REG_1, ipNet.Mask))
+		ip = network
+	}
+	a.add(exprCmp(unix.NFT_CMP_EQ, unix.NFT_REG_1, ip))
+	return nil
+}
+
+// addIfaceMatch matches an interface name in the FirewallRule format
+func (a *nlAttrs) addIfaceMatch(key uint32, iface string) {
+	op := uint32(unix.NFT_CMP_EQ)
+	if strings.HasPrefix(iface, "!") {
+		op = unix.NFT_CMP_NEQ
+		iface = iface[1:]
+	}
+
+	// Comparing without the trailing NUL turns the match into a prefix match
+	data := []byte(iface + "\x00")
+	if strings.HasSuffix(iface, "+") {
+		data = []byte(strings.TrimSuffix(iface, "+"))
+	}
+
+	a.add(exprMeta(key, unix.NFT_REG_1))
+	a.add(exprCmp(op, unix.NFT_REG_1, data))
+}
+
+// parseAddrOrCIDR accepts either a plain address or a CIDR
+func parseAddrOrCIDR(addr string) (net.IP, *net.IPNet, error) {
+	if strings.Contains(addr, "/") {
+		ip, ipNet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CIDR %q", addr)
+		}
+		return ip, ipNet, nil
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid address %q", addr)
+	}
+	bits := 8 * len(ip)
+	if ip.To4() != nil {
+		bits = 32
+	}
+	return ip, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// protoNumber converts a protocol name to its IP protocol number
+func protoNumber(proto string) (byte, error) {
+	switch proto {
+	case "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	case "icmpv6":
+		return unix.IPPROTO_ICMPV6, nil
+	}
+	return 0, fmt.Errorf("unsupported protocol %q", proto)
+}
+
+// be16 encodes a value in network byte order
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+// nftExpr wraps an expression's attributes in a list element
+func nftExpr(name string, data nlAttrs) nlAttrs {
+	var expr nlAttrs
+	expr.addString(unix.NFTA_EXPR_NAME, name)
+	if data != nil {
+		expr.addNested(unix.NFTA_EXPR_DATA, data)
+	}
+
+	var elem nlAttrs
+	elem.addNested(unix.NFTA_LIST_ELEM, expr)
+	return elem
+}
+
+func exprMeta(key, reg uint32) nlAttrs {
+	var data nlAttrs
+	data.addU32(unix.NFTA_META_KEY, key)
+	data.addU32(unix.NFTA_META_DREG, reg)
+	return nftExpr("meta", data)
+}
+
+func exprPayload(base, offset, length, reg uint32) nlAttrs {
+	var data nlAttrs
+	data.addU32(unix.NFTA_PAYLOAD_DREG, reg)
+	data.addU32(unix.NFTA_PAYLOAD_BASE, base)
+	data.addU32(unix.NFTA_PAYLOAD_OFFSET, offset)
+	data.addU32(unix.NFTA_PAYLOAD_LEN, length)
+	return nftExpr("payload", data)
+}
+
+func exprCmp(op, reg uint32, value []byte) nlAttrs {
+	var data nlAttrs
+	data.addU32(unix.NFTA_CMP_SREG, reg)
+	data.addU32(unix.NFTA_CMP_OP, op)
+	data.addNested(unix.NFTA_CMP_DATA, dataValue(value))
+	return nftExpr("cmp", data)
+}
+
+func exprBitwise(reg uint32, mask []byte) nlAttrs {
+	var data nlAttrs
+	data.addU32(unix.NFTA_BITWISE_SREG, reg)
+	data.addU32(unix.NFTA_BITWISE_DREG, reg)
+	data.addU32(unix.NFTA_BITWISE_LEN, uint32(len(mask)))
+	data.addNested(unix.NFTA_BITWISE_MASK, dataValue(mask))
+	data.addNested(unix.NFTA_BITWISE_XOR, dataValue(make([]byte, len(mask))))
+	return nftExpr("bitwise", data)
+}
+
+func exprFibDaddrType(reg uint32) nlAttrs {
+	var data nlAttrs
+	data.addU32(unix.NFTA_FIB_DREG, reg)
+	data.addU32(unix.NFTA_FIB_RESULT, unix.NFT_FIB_RESULT_ADDRTYPE)
+	data.addU32(unix.NFTA_FIB_FLAGS, unix.NFTA_FIB_F_DADDR)
+	return nftExpr("fib", data)
+}
+
+func exprCt(key, reg uint32) nlAttrs {
+	var data nlAttrs
+	data.addU32(unix.NFTA_CT_KEY, key)
+	data.addU32(unix.NFTA_CT_DREG, reg)
+	return nftExpr("ct", data)
+}
+
+// exprLimit matches at most perSecond packets a second, with the same burst
+// of 5 packets as iptables' limit match
+func exprLimit(perSecond uint64) nlAttrs {
+	var data nlAttrs
+	data.addU64(unix.NFTA_LIMIT_RATE, perSecond)
+	data.addU64(unix.NFTA_LIMIT_UNIT, 1)
+	data.addU32(unix.NFTA_LIMIT_BURST, 5)
+	data.addU32(unix.NFTA_LIMIT_TYPE, unix.NFT_LIMIT_PKTS)
+	return nftExpr("limit", data)
+}
+
+func exprLog(prefix string) nlAttrs {
+	var data nlAttrs
+	data.addString(unix.NFTA_LOG_PREFIX, prefix)
+	return nftExpr("log", data)
+}
+
+func exprImmediate(reg uint32, value []byte) nlAttrs {
+	var data nlAttrs
+	data.addU32(unix.NFTA_IMMEDIATE_DREG, reg)
+	data.addNested(unix.NFTA_IMMEDIATE_DATA, dataValue(value))
+	return nftExpr("immediate", data)
+}
+
+func exprVerdict(code uint32) nlAttrs {
+	var verdict nlAttrs
+	verdict.addU32(unix.NFTA_VERDICT_CODE, code)
+
+	var value nlAttrs
+	value.addNested(unix.NFTA_DATA_VERDICT, verdict)
+
+	var data nlAttrs
+	data.addU32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_VERDICT)
+	data.addNested(unix.NFTA_IMMEDIATE_DATA, value)
+	return nftExpr("immediate", data)
+}
+
+func exprDNAT(family, addrReg, portReg uint32) nlAttrs {
+	var data nlAttrs
+	data.addU32(unix.NFTA_NAT_TYPE, unix.NFT_NAT_DNAT)
+	data.addU32(unix.NFTA_NAT_FAMILY, family)
+	data.addU32(unix.NFTA_NAT_REG_ADDR_MIN, addrReg)
+	data.addU32(unix.NFTA_NAT_REG_PROTO_MIN, portReg)
+	return nftExpr("nat", data)
+}
+
+// dataValue wraps raw bytes in an NFTA_DATA_VALUE attribute
+func dataValue(value []byte) nlAttrs {
+	var data nlAttrs
+	data.addBytes(unix.NFTA_DATA_VALUE, value)
+	return data
+}
+
+// nlAttrs is a buffer of serialized netlink attributes
+type nlAttrs []byte
+
+// add appends already serialized attributes
+func (a *nlAttrs) add(attrs nlAttrs) {
+	*a = append(*a, attrs...)
+}
+
+// addBytes appends an attribute, padding it to a 4 byte boundary
+func (a *nlAttrs) addBytes(attrType uint16, value []byte) {
+	length := unix.SizeofNlAttr + len(value)
+	buf := make([]byte, nlAlign(length))
+	nl.NativeEndian().PutUint16(buf[0:2], uint16(length))
+	nl.NativeEndian().PutUint16(buf[2:4], attrType)
+	copy(buf[unix.SizeofNlAttr:], value)
+	*a = append(*a, buf...)
+}
+
+// addString appends a NUL terminated string attribute
+func (a *nlAttrs) addString(attrType uint16, value string) {
+	a.addBytes(attrType, append([]byte(value), 0))
+}
+
+// addU32 appends a 32 bit attribute in network byte order, as nf_tables expects
+func (a *nlAttrs) addU32(attrType uint16, value uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	a.addBytes(attrType, b)
+}
+
+// addU64 appends a 64 bit attribute in network byte order
+func (a *nlAttrs) addU64(attrType uint16, value uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, value)
+	a.addBytes(attrType, b)
+}
+
+// addNested appends a nested attribute
+func (a *nlAttrs) addNested(attrType uint16, value nlAttrs) {
+	a.addBytes(attrType|unix.NLA_F_NESTED, value)
+}
+
+// nlAlign rounds a length up to the netlink attribute alignment
+func nlAlign(length int) int {
+	return (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
@@ -3,7 +3,8 @@ module github.com/yashraj-n/namespace-containers
 go 1.21
 
 require (
-	github.com/vishvananda/netlink v1.3.1 // indirect
-	github.com/vishvananda/netns v0.0.5 // indirect
-	golang.org/x/sys v0.10.0 // indirect
+	github.com/vishvananda/netlink v1.3.1
+	github.com/vishvananda/netns v0.0.5
 )
+
+require golang.org/x/sys v0.10.0
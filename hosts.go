@@ -0,0 +1,144 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// loopbackHostname is where the hostname points when the container has no
+// address of its own, following the Debian convention
+const loopbackHostname = "127.0.1.1"
+
+// defaultHosts are the entries every container's /etc/hosts starts with
+var defaultHosts = []HostEntry{
+	{Name: "localhost", IP: "127.0.0.1"},
+	{Name: "localhost ip6-localhost ip6-loopback", IP: "::1"},
+	{Name: "ip6-localnet", IP: "fe00::0"},
+	{Name: "ip6-mcastprefix", IP: "ff00::0"},
+	{Name: "ip6-allnodes", IP: "ff02::1"},
+	{Name: "ip6-allrouters", IP: "ff02::2"},
+}
+
+// containerHosts returns the /etc/hosts of a container: the defaults, the
+// container's own name, --add-host entries and the other containers on its network
+func containerHosts(config *ContainerConfig, peers []*ContainerState) []byte {
+	var buf bytes.Buffer
+	for _, entry := range defaultHosts {
+		fmt.Fprintf(&buf, "%s\t%s\n", entry.IP, entry.Name)
+	}
+
+	// The container's own name, so tools resolving it don't hang
+	if config.ContainerIP != "" {
+		fmt.Fprintf(&buf, "%s\t%s\n", config.ContainerIP, config.Hostname)
+	} else {
+		fmt.Fprintf(&buf, "%s\t%s\n", loopbackHostname, config.Hostname)
+	}
+	if config.ContainerIPv6 != "" {
+		fmt.Fprintf(&buf, "%s\t%s\n", config.ContainerIPv6, config.Hostname)
+	}
+
+	if len(config.ExtraHosts) > 0 {
+		fmt.Fprintf(&buf, "\n# Added with --add-host\n")
+		for _, entry := range config.ExtraHosts {
+			fmt.Fprintf(&buf, "%s\t%s\n", entry.IP, entry.Name)
+		}
+	}
+
+	if len(peers) > 0 {
+		fmt.Fprintf(&buf, "\n# Containers on network %s\n", config.Network)
+		for _, peer := range peers {
+			names := strings.Join(containerNames(peer.Config), " ")
+			fmt.Fprintf(&buf, "%s\t%s\n", peer.Config.ContainerIP, names)
+			if peer.Config.ContainerIPv6 != "" {
+				fmt.Fprintf(&buf, "%s\t%s\n", peer.Config.ContainerIPv6, names)
+			}
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// containerNames returns every name other containers on the network know the container by
+func containerNames(config *ContainerConfig) []string {
+	names := []string{config.Hostname}
+	if config.Name != "" {
+		names = append(names, config.Name)
+	}
+	names = append(names, config.NetworkAliases...)
+	return unique(append(names, shortID(config.ID)))
+}
+
+// networkPeers returns the running containers attached to the same
+// network as config, excluding the container itself
+func networkPeers(config *ContainerConfig, states []*ContainerState) []*ContainerState {
+	if !attachedToNetwork(config) {
+		return nil
+	}
+
+	var peers []*ContainerState
+	for _, state := range states {
+		if state.Config.ID != config.ID && state.Config.Network == config.Network {
+			peers = append(peers, state)
+		}
+	}
+	return peers
+}
+
+// WriteHostsFiles generates the container's /etc/hosts and /etc/hostname in
+// its state directory, from where they are bind mounted into the container
+func WriteHostsFiles(config *ContainerConfig) error {
+	if err := ensureDir(containerDir(config.ID), 0755); err != nil {
+		return fmt.Errorf("failed to create container directory: %v", err)
+	}
+
+	if err := ioutil.WriteFile(containerFile(config.ID, "hostname"), []byte(config.Hostname+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write hostname: %v", err)
+	}
+
+	return withLockedFile(runtimePath("containers", "hosts"), func() error {
+		states, err := ListContainerStates()
+		if err != nil {
+			return err
+		}
+		return writeHosts(config, networkPeers(config, states))
+	})
+}
+
+// RefreshNetworkHosts rewrites /etc/hosts of every running container on the
+// same network as config, after config's container started or exited
+func RefreshNetworkHosts(config *ContainerConfig) error {
+	if !attachedToNetwork(config) {
+		return nil
+	}
+
+	return withLockedFile(runtimePath("containers", "hosts"), func() error {
+		states, err := ListContainerStates()
+		if err != nil {
+			return err
+		}
+
+		for _, state := range states {
+			if state.Config.Network != config.Network {
+				continue
+			}
+			if err := writeHosts(state.Config, networkPeers(state.Config, states)); err != nil {
+				logError("%v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// writeHosts writes a container's hosts file in place. The file is bind
+// mounted into the running container, so it must keep its inode.
+func writeHosts(config *ContainerConfig, peers []*ContainerState) error {
+	if err := ioutil.WriteFile(containerFile(config.ID, "hosts"), containerHosts(config, peers), 0644); err != nil {
+		return fmt.Errorf("failed to write hosts for container %s: %v", shortID(config.ID), err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// newIDMapUserns creates a user namespace with the mapping of an idmapped
+// mount and returns it as a file. A user namespace only exists while
+// something holds it, so a process is started in it under ptrace, which
+// stops it before it runs, and killed once the namespace is open.
+func newIDMapUserns(mappings []IDMapping) (*os.File, error) {
+	// The mount shows the IDs on disk as the IDs they map to from inside
+	// the namespace, so the namespace maps host IDs to container IDs
+	var ids []syscall.SysProcIDMap
+	for _, mapping := range mappings {
+		ids = append(ids, syscall.SysProcIDMap{
+			ContainerID: int(mapping.HostID),
+			HostID:      int(mapping.ContainerID),
+			Size:        int(mapping.Size),
+		})
+	}
+
+	// The tracer is the thread that started the process
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: ids,
+		GidMappings: ids,
+		Ptrace:      true,
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to create user namespace for idmap: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	userns, err := os.Open(fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user namespace for idmap: %v", err)
+	}
+	return userns, nil
+}
+
+// createIDMappedBind bind mounts the source at mountPoint through the user
+// namespace of the mount, so files owned by a host ID in the mapping appear
+// owned by the container ID and files the container creates get the host
+// ID. Runs in the child, which closes the namespace once it is used.
+func createIDMappedBind(mount Mount, mountPoint string) error {
+	defer unix.Close(mount.usernsFd)
+
+	openFlags := unix.OPEN_TREE_CLONE | unix.OPEN_TREE_CLOEXEC
+	attrFlags := unix.AT_EMPTY_PATH
+	if !mount.NonRecursive {
+		openFlags |= unix.AT_RECURSIVE
+		attrFlags |= unix.AT_RECURSIVE
+	}
+
+	tree, err := unix.OpenTree(unix.AT_FDCWD, mount.Source, uint(openFlags))
+	if err == unix.ENOSYS {
+		return fmt.Errorf("idmap needs the new mount API of Linux 5.12 or later")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to clone %s: %v", mount.Source, err)
+	}
+	defer unix.Close(tree)
+
+	attr := &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_IDMAP, Userns_fd: uint64(mount.usernsFd)}
+	switch err := unix.MountSetattr(tree, "", uint(attrFlags), attr); err {
+	case nil:
+	case unix.ENOSYS:
+		return fmt.Errorf("idmap needs mount_setattr, available from Linux 5.12")
+	case unix.EINVAL:
+		return fmt.Errorf("the filesystem of %s, or one mounted below it, doesn't support idmapped mounts on this kernel", mount.Source)
+	default:
+		return fmt.Errorf("failed to idmap %s: %v", mount.Source, err)
+	}
+
+	if err := unix.MoveMount(tree, "", unix.AT_FDCWD, mountPoint, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("failed to attach idmapped mount: %v", err)
+	}
+	return nil
+}
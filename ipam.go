@@ -0,0 +1,248 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// IPPool tracks the addresses handed out from a single subnet
+type IPPool struct {
+	Subnet    string            `json:"subnet"`
+	Gateway   string            `json:"gateway"`
+	Allocated map[string]string `json:"allocated"`        // IP -> container ID
+	Owners    map[string]int    `json:"owners,omitempty"` // Container ID -> PID of the runtime holding its addresses
+}
+
+// ipamPath returns the on-disk location of the named pool
+func ipamPath(pool string) string {
+	return runtimePath("ipam", pool+".json")
+}
+
+// AllocateIP reserves an address in subnet for the container. If requested is
+// non-empty that exact address is reserved, otherwise the lowest free one is used.
+func AllocateIP(pool, subnet, gateway, containerID, requested string) (net.IP, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %v", subnet, err)
+	}
+
+	gw := net.ParseIP(gateway)
+	if gw == nil || !ipNet.Contains(gw) {
+		return nil, fmt.Errorf("gateway %s is not in subnet %s", gateway, subnet)
+	}
+
+	var allocated net.IP
+	path := ipamPath(pool)
+	err = withLockedFile(path, func() error {
+		ipPool := &IPPool{}
+		if err := readJSONFile(path, ipPool); err != nil {
+			return err
+		}
+		if ipPool.Subnet != "" && ipPool.Subnet != ipNet.String() && len(ipPool.Allocated) > 0 {
+			return fmt.Errorf("pool %s already manages subnet %s", pool, ipPool.Subnet)
+		}
+		if ipPool.Allocated == nil {
+			ipPool.Allocated = make(map[string]string)
+		}
+		if ipPool.Owners == nil {
+			ipPool.Owners = make(map[string]int)
+		}
+		ipPool.dropStale()
+		ipPool.Subnet = ipNet.String()
+		ipPool.Gateway = gw.String()
+
+		if requested != "" {
+			ip := net.ParseIP(requested)
+			if ip == nil || !ipNet.Contains(ip) {
+				return fmt.Errorf("requested IP %s is not in subnet %s", requested, subnet)
+			}
+			if ip.Equal(gw) {
+				return fmt.Errorf("requested IP %s is the gateway address", requested)
+			}
+			if ip.Equal(ipNet.IP) || ip.Equal(lastIP(ipNet)) {
+				return fmt.Errorf("requested IP %s is the network or broadcast address of %s", requested, subnet)
+			}
+			if owner, ok := ipPool.Allocated[ip.String()]; ok {
+				return fmt.Errorf("IP %s is already in use by container %s", requested, shortID(owner))
+			}
+			allocated = ip
+		} else {
+			allocated = findFreeIP(ipNet, gw, ipPool.Allocated)
+			if allocated == nil {
+				return fmt.Errorf("no free addresses left in %s", subnet)
+			}
+		}
+
+		ipPool.Allocated[allocated.String()] = containerID
+		ipPool.Owners[containerID] = os.Getpid()
+		return writeJSONFile(path, ipPool)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return allocated, nil
+}
+
+// ReleaseIP returns every address held by the container to the pool
+func ReleaseIP(pool, containerID string) error {
+	path := ipamPath(pool)
+	return withLockedFile(path, func() error {
+		ipPool := &IPPool{}
+		if err := readJSONFile(path, ipPool); err != nil {
+			return err
+		}
+
+		for ip, owner := range ipPool.Allocated {
+			if owner == containerID {
+				delete(ipPool.Allocated, ip)
+			}
+		}
+		delete(ipPool.Owners, containerID)
+
+		return writeJSONFile(path, ipPool)
+	})
+}
+
+// dropStale frees the addresses of containers whose runtime process was
+// killed before it could release them. Addresses recorded before owners
+// were are kept, there is no telling whether they are in use.
+func (p *IPPool) dropStale() {
+	for id, pid := range p.Owners {
+		if processAlive(pid) {
+			continue
+		}
+		for ip, owner := range p.Allocated {
+			if owner == id {
+				delete(p.Allocated, ip)
+			}
+		}
+		delete(p.Owners, id)
+	}
+}
+
+// PortReservation is the host ports a container publishes, held by the
+// runtime process with PID
+type PortReservation struct {
+	PID   int
+	Ports []PortMapping
+}
+
+// portsPath records the published ports of every container, by container ID
+var portsPath = runtimePath("ports.json")
+
+// ReservePorts claims the host ports the container publishes. Only the first
+// DNAT rule for a port ever matches, so a port published twice, or already
+// published by another container, is refused.
+func ReservePorts(config *ContainerConfig) error {
+	if len(config.Ports) == 0 {
+		return nil
+	}
+
+	for i, port := range config.Ports {
+		for _, other := range config.Ports[:i] {
+			if portsOverlap(port, other) {
+				return fmt.Errorf("cannot publish %s: %s is already published", port, other)
+			}
+		}
+	}
+
+	return withLockedFile(portsPath, func() error {
+		reserved := make(map[string]PortReservation)
+		if err := readJSONFile(portsPath, &reserved); err != nil {
+			return err
+		}
+
+		for id, reservation := range reserved {
+			// Drop reservations left behind by runtime processes that were killed
+			if !processAlive(reservation.PID) {
+				delete(reserved, id)
+				continue
+			}
+			if id == config.ID {
+				continue
+			}
+			for _, port := range config.Ports {
+				for _, other := range reservation.Ports {
+					if portsOverlap(port, other) {
+						return fmt.Errorf("cannot publish %s: container %s already publishes %s", port, shortID(id), other)
+					}
+				}
+			}
+		}
+
+		reserved[config.ID] = PortReservation{PID: os.Getpid(), Ports: config.Ports}
+		return writeJSONFile(portsPath, reserved)
+	})
+}
+
+// ReleasePorts gives up the host ports the container published
+func ReleasePorts(containerID string) error {
+	return withLockedFile(portsPath, func() error {
+		reserved := make(map[string]PortReservation)
+		if err := readJSONFile(portsPath, &reserved); err != nil {
+			return err
+		}
+		if _, ok := reserved[containerID]; !ok {
+			return nil
+		}
+
+		delete(reserved, containerID)
+		return writeJSONFile(portsPath, reserved)
+	})
+}
+
+// portsOverlap reports whether two mappings claim the same host port, on the
+// same address or with either listening on all of them
+func portsOverlap(a, b PortMapping) bool {
+	if a.HostPort != b.HostPort || a.Protocol != b.Protocol {
+		return false
+	}
+	return a.HostIP == "" || b.HostIP == "" || net.ParseIP(a.HostIP).Equal(net.ParseIP(b.HostIP))
+}
+
+// findFreeIP returns the first usable host address not in use, skipping the
+// network and broadcast addresses
+func findFreeIP(ipNet *net.IPNet, gateway net.IP, allocated map[string]string) net.IP {
+	broadcast := lastIP(ipNet)
+	for ip := nextIP(ipNet.IP); ipNet.Contains(ip) && !ip.Equal(broadcast); ip = nextIP(ip) {
+		if ip.Equal(gateway) {
+			continue
+		}
+		if _, used := allocated[ip.String()]; !used {
+			return ip
+		}
+	}
+	return nil
+}
+
+// nextIP returns ip incremented by one
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// lastIP returns the highest address in the network
+func lastIP(ipNet *net.IPNet) net.IP {
+	last := make(net.IP, len(ipNet.IP))
+	for i := range ipNet.IP {
+		last[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+	}
+	return last
+}
+
+// firstHostIP returns the first usable address in the network, conventionally the gateway
+func firstHostIP(ipNet *net.IPNet) net.IP {
+	return nextIP(ipNet.IP)
+}
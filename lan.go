@@ -0,0 +1,161 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// macvlanModes and ipvlanModes map the network's mode onto the kernel's
+var (
+	macvlanModes = map[string]netlink.MacvlanMode{
+		"bridge":   netlink.MACVLAN_MODE_BRIDGE,
+		"private":  netlink.MACVLAN_MODE_PRIVATE,
+		"vepa":     netlink.MACVLAN_MODE_VEPA,
+		"passthru": netlink.MACVLAN_MODE_PASSTHRU,
+	}
+	ipvlanModes = map[string]netlink.IPVlanMode{
+		"l2":  netlink.IPVLAN_MODE_L2,
+		"l3":  netlink.IPVLAN_MODE_L3,
+		"l3s": netlink.IPVLAN_MODE_L3S,
+	}
+)
+
+// newLANLink describes a macvlan or ipvlan sub-interface of the network's parent
+func newLANLink(network *Network, parentIndex int, name string) netlink.Link {
+	attrs := netlink.LinkAttrs{Name: name, ParentIndex: parentIndex}
+	if network.Driver == driverIPvlan {
+		return &netlink.IPVlan{LinkAttrs: attrs, Mode: ipvlanModes[network.Mode]}
+	}
+	return &netlink.Macvlan{LinkAttrs: attrs, Mode: macvlanModes[network.Mode]}
+}
+
+// setupLANNetworking gives the container a macvlan or ipvlan interface on the
+// network's parent and assigns its static or leased address. Nothing changes
+// on the host: no bridge, forwarding or firewall rules are involved.
+func setupLANNetworking(config *ContainerConfig, hostNs, containerNs netns.NsHandle) error {
+	network, err := LoadNetwork(config.Network)
+	if err != nil {
+		return err
+	}
+
+	parent, err := netlink.LinkByName(network.Parent)
+	if err != nil {
+		return fmt.Errorf("parent interface %s of network %s not found: %v", network.Parent, network.Name, err)
+	}
+
+	// The parent must be up for the sub-interface to come up
+	if err := netlink.LinkSetUp(parent); err != nil {
+		return fmt.Errorf("failed to bring up %s: %v", network.Parent, err)
+	}
+
+	_, config.PeerVeth = vethNames(config.ID)
+	link := newLANLink(network, parent.Attrs().Index, config.PeerVeth)
+	if err := netlink.LinkAdd(link); err != nil {
+		return fmt.Errorf("failed to create %s interface on %s, is the %s module available? %v", network.Driver, network.Parent, network.Driver, err)
+	}
+
+	if err := netlink.LinkSetNsFd(link, int(containerNs)); err != nil {
+		netlink.LinkDel(link)
+		return fmt.Errorf("failed to move %s to container: %v", config.PeerVeth, err)
+	}
+
+	// Switch to container namespace and configure
+	if err := netns.Set(containerNs); err != nil {
+		return fmt.Errorf("failed to switch to container namespace: %v", err)
+	}
+
+	err = configureLANIface(config, network)
+
+	// Switch back to host namespace
+	if setErr := netns.Set(hostNs); setErr != nil {
+		return fmt.Errorf("failed to switch back to host namespace: %v", setErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to configure container network: %v", err)
+	}
+
+	// The resolv.conf written before the container started couldn't know
+	// the servers handed out with the lease
+	if config.DHCPLease != nil {
+		return WriteResolvConf(config)
+	}
+	return nil
+}
+
+// configureLANIface brings up the container's interface and assigns its
+// address, leasing one first on DHCP networks. Runs in the container namespace.
+func configureLANIface(config *ContainerConfig, network *Network) error {
+	eth0, err := bringUpContainerIface(config)
+	if err != nil {
+		return err
+	}
+
+	if !network.DHCP {
+		return addContainerAddresses(eth0, config)
+	}
+
+	// The client's socket belongs to the container namespace, so it can keep
+	// renewing the lease from any thread
+	client, err := newDHCPClient(eth0, config)
+	if err != nil {
+		return err
+	}
+
+	lease, err := client.acquire()
+	if err != nil {
+		client.close()
+		return err
+	}
+
+	ipNet := &net.IPNet{IP: lease.ip, Mask: lease.mask}
+	config.ContainerIP = lease.ip.String()
+	config.NetworkCIDR = ipNet.String()
+	config.HostIP = ""
+	if lease.router != nil {
+		config.HostIP = lease.router.String()
+	}
+	config.DHCPLease = lease.record()
+	logInfo("Leased %s from DHCP server %s", ipNet, config.DHCPLease.Server)
+
+	if err := addContainerAddresses(eth0, config); err != nil {
+		client.release()
+		client.close()
+		return err
+	}
+
+	startDHCPRenewal(config.ID, client)
+	return nil
+}
+
+// cleanupLANNetwork gives up the container's lease or static addresses. The
+// sub-interface disappears with the container's namespace.
+func cleanupLANNetwork(config *ContainerConfig) {
+	// A setup that failed before moving the interface leaves it on the host
+	if config.PeerVeth != "" {
+		if link, err := netlink.LinkByName(config.PeerVeth); err == nil {
+			netlink.LinkDel(link)
+		}
+	}
+
+	// Leased addresses go back to the DHCP server, not to our IPAM
+	stopDHCPRenewal(config.ID)
+	if config.DHCPLease != nil || config.ContainerIP == "" {
+		return
+	}
+
+	if err := ReleaseIP(config.Network, config.ID); err != nil {
+		logError("Failed to release IP address: %v", err)
+	}
+
+	if config.ContainerIPv6 != "" {
+		if err := ReleaseIP(ipv6Pool(config.Network), config.ID); err != nil {
+			logError("Failed to release IPv6 address: %v", err)
+		}
+	}
+}
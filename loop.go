@@ -0,0 +1,118 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// loFlagsAutoclear detaches a loop device once nothing uses it, from linux/loop.h
+const loFlagsAutoclear = 4
+
+// createExt4Image creates a sparse file of the given size formatted as ext4
+func createExt4Image(path string, size uint64) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create image %s: %v", path, err)
+	}
+	err = file.Truncate(int64(size))
+	file.Close()
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to size image %s: %v", path, err)
+	}
+
+	// No blocks reserved for root, the whole size is usable
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", "-E", "nodiscard", path).CombinedOutput()
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to format image %s, is mkfs.ext4 installed? %v: %s", path, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// mountImage mounts an ext4 image on target through a loop device. The loop
+// device is released again when the image is unmounted.
+func mountImage(image, target string, flags uintptr) error {
+	loop, err := attachLoop(image)
+	if err != nil {
+		return err
+	}
+	// Closing the device before mounting would detach it
+	defer loop.Close()
+
+	if err := syscall.Mount(loop.Name(), target, "ext4", flags, ""); err != nil {
+		return fmt.Errorf("failed to mount %s on %s: %v", image, target, err)
+	}
+
+	return nil
+}
+
+// attachLoop attaches an image to a free loop device and returns the open
+// device, which detaches once it is closed and no longer mounted
+func attachLoop(image string) (*os.File, error) {
+	control, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open loop control, is the loop module available? %v", err)
+	}
+	defer control.Close()
+
+	backing, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image %s: %v", image, err)
+	}
+	defer backing.Close()
+
+	// Another process may take the free device before us, then ask again
+	for attempt := 0; attempt < 10; attempt++ {
+		n, err := unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find a free loop device: %v", err)
+		}
+
+		loop, err := os.OpenFile(fmt.Sprintf("/dev/loop%d", n), os.O_RDWR, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open loop device: %v", err)
+		}
+
+		err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd()))
+		if err == unix.EBUSY {
+			loop.Close()
+			continue
+		}
+		if err != nil {
+			loop.Close()
+			return nil, fmt.Errorf("failed to attach %s to %s: %v", image, loop.Name(), err)
+		}
+
+		info := &unix.LoopInfo64{Flags: loFlagsAutoclear}
+		copy(info.File_name[:], image)
+		if err := unix.IoctlLoopSetStatus64(int(loop.Fd()), info); err != nil {
+			unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+			loop.Close()
+			return nil, fmt.Errorf("failed to configure %s: %v", loop.Name(), err)
+		}
+
+		return loop, nil
+	}
+
+	return nil, fmt.Errorf("no free loop device for %s", image)
+}
+
+// isMountPoint reports whether something is mounted on path, i.e. it lives on
+// another device than its parent directory
+func isMountPoint(path string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(path, &st) != nil || syscall.Stat(path+"/..", &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
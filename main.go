@@ -4,8 +4,14 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 func main() {
@@ -34,6 +40,30 @@ func main() {
 		handleRun(os.Args[2:])
 	case "child":
 		handleChild(os.Args[2:])
+	case "fs-helper":
+		handleFSHelper(os.Args[2:])
+	case "dns-server":
+		handleDNSServer(os.Args[2:])
+	case "network":
+		handleNetwork(os.Args[2:])
+	case "volume":
+		handleVolume(os.Args[2:])
+	case "update":
+		handleUpdate(os.Args[2:])
+	case "stats":
+		handleStats(os.Args[2:])
+	case "inspect":
+		handleInspect(os.Args[2:])
+	case "cp":
+		handleCp(os.Args[2:])
+	case "diff":
+		handleDiff(os.Args[2:])
+	case "export":
+		handleExport(os.Args[2:])
+	case "import":
+		handleImport(os.Args[2:])
+	case "rootfs":
+		handleRootFS(os.Args[2:])
 	default:
 		logError("Unknown command: %s", os.Args[1])
 		printUsage()
@@ -72,45 +102,761 @@ func handleChild(args []string) {
 	}
 }
 
+// handleDNSServer runs a network's embedded DNS server, started in the
+// background by the first container on the network
+func handleDNSServer(args []string) {
+	if len(args) != 1 {
+		logError("No network specified for DNS server")
+		os.Exit(1)
+	}
+
+	if err := RunDNSServer(args[0]); err != nil {
+		logError("DNS server failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+// handleUpdate changes settings of a running container
+func handleUpdate(args []string) {
+	flagSet := flag.NewFlagSet("update", flag.ExitOnError)
+	rate := flagSet.String("network-rate", "", "Limit bandwidth in each direction, 0 removes the limit")
+	delay := flagSet.String("network-delay", "", "Add latency in each direction, 0 removes it")
+	loss := flagSet.String("network-loss", "", "Drop a percentage of packets in each direction, 0 stops dropping")
+	flagSet.Parse(args)
+
+	if flagSet.NArg() != 1 {
+		logError("usage: update [--network-rate RATE] [--network-delay DELAY] [--network-loss PERCENT] CONTAINER")
+		os.Exit(1)
+	}
+
+	state, err := UpdateShaping(flagSet.Arg(0), func(shaping *NetworkShaping) error {
+		return shaping.Set(*rate, *delay, *loss)
+	})
+	if err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s: network shaping %s\n", shortID(state.Config.ID), state.Config.Shaping)
+}
+
+// handleStats shows the network traffic of running containers, busiest first
+func handleStats(args []string) {
+	flagSet := flag.NewFlagSet("stats", flag.ExitOnError)
+	interval := flagSet.Duration("interval", time.Second, "How long to measure the current rates for")
+	flagSet.Parse(args)
+
+	if err := containerStats(flagSet.Args(), *interval); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+}
+
+// handleInspect prints a running container's state and network counters as JSON
+func handleInspect(args []string) {
+	if len(args) != 1 {
+		logError("usage: inspect CONTAINER")
+		os.Exit(1)
+	}
+
+	if err := containerInspect(args[0]); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+}
+
+// handleCp copies files between a container and the host
+func handleCp(args []string) {
+	if len(args) != 2 {
+		logError("usage: cp CONTAINER:SRC_PATH DEST_PATH|-  or  cp SRC_PATH|- CONTAINER:DEST_PATH")
+		os.Exit(1)
+	}
+
+	if err := CopyFiles(args[0], args[1]); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+}
+
+// handleFSHelper runs a file operation inside a container's root for cp,
+// reporting errors as plain text for the runtime to pass on
+func handleFSHelper(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: fs-helper ROOT COMMAND [ARG...]")
+		os.Exit(1)
+	}
+
+	if err := FSHelper(args[0], args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// handleDiff lists the paths a container changed in its rootfs
+func handleDiff(args []string) {
+	if len(args) != 1 {
+		logError("usage: diff CONTAINER")
+		os.Exit(1)
+	}
+
+	state, err := FindContainer(args[0])
+	if err == nil {
+		var changes []Change
+		if changes, err = ContainerDiff(state); err == nil {
+			for _, change := range changes {
+				fmt.Println(change)
+			}
+		}
+	}
+	if err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+}
+
+// handleExport writes a container's root filesystem as a tar archive
+func handleExport(args []string) {
+	flagSet := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flagSet.String("o", "-", "File to write the archive to, - for stdout")
+	flagSet.Parse(args)
+
+	refs := parseTrailingFlags(flagSet)
+	if len(refs) != 1 {
+		logError("usage: export CONTAINER [-o FILE]")
+		os.Exit(1)
+	}
+
+	if err := exportContainer(refs[0], *output); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+}
+
+// parseTrailingFlags parses the flags that follow the first argument too,
+// and returns the arguments
+func parseTrailingFlags(flagSet *flag.FlagSet) []string {
+	if flagSet.NArg() == 0 {
+		return nil
+	}
+
+	args := []string{flagSet.Arg(0)}
+	flagSet.Parse(flagSet.Args()[1:])
+	return append(args, flagSet.Args()...)
+}
+
+// exportContainer writes the archive of a container to a file, or stdout
+func exportContainer(ref, output string) error {
+	state, err := FindContainer(ref)
+	if err != nil {
+		return err
+	}
+	if output == "-" {
+		return ExportContainer(state, os.Stdout)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	err = ExportContainer(state, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+	}
+	return err
+}
+
+// handleImport unpacks a root filesystem archive into a new rootfs directory
+func handleImport(args []string) {
+	if len(args) != 2 {
+		logError("usage: import FILE|- DIRECTORY")
+		os.Exit(1)
+	}
+
+	input := os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			logError("%v", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	if err := ImportRootFS(input, args[1]); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+}
+
+// handleRootFS handles rootfs subcommands
+func handleRootFS(args []string) {
+	if len(args) == 0 || args[0] != "create" {
+		logError("usage: rootfs create DIRECTORY --from-host-binaries BINARY[,BINARY...]")
+		os.Exit(1)
+	}
+
+	flagSet := flag.NewFlagSet("rootfs create", flag.ExitOnError)
+	binaries := flagSet.String("from-host-binaries", "", "Comma-separated host executables to copy with their shared libraries")
+	flagSet.Parse(args[1:])
+
+	dirs := parseTrailingFlags(flagSet)
+	if len(dirs) != 1 || *binaries == "" {
+		logError("usage: rootfs create DIRECTORY --from-host-binaries BINARY[,BINARY...]")
+		os.Exit(1)
+	}
+
+	if err := CreateRootFS(dirs[0], strings.Split(*binaries, ",")); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+	logInfo("Created rootfs %s", dirs[0])
+}
+
+// selectContainers returns the referenced containers, or every running container
+func selectContainers(refs []string) ([]*ContainerState, error) {
+	if len(refs) == 0 {
+		return ListContainerStates()
+	}
+
+	var states []*ContainerState
+	for _, ref := range refs {
+		state, err := FindContainer(ref)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func containerStats(refs []string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+
+	states, err := selectContainers(refs)
+	if err != nil {
+		return err
+	}
+
+	configs := make([]*ContainerConfig, len(states))
+	for i, state := range states {
+		configs[i] = state.Config
+	}
+
+	// Sample the counters twice to work out the current rates
+	before, err := CollectNetworkStats(configs)
+	if err != nil {
+		return err
+	}
+	time.Sleep(interval)
+	after, err := CollectNetworkStats(configs)
+	if err != nil {
+		return err
+	}
+
+	perSecond := func(now, then uint64) uint64 {
+		if now < then {
+			return 0
+		}
+		return uint64(float64(now-then) / interval.Seconds())
+	}
+	// Containers without counters of their own go last
+	rate := func(id string) int64 {
+		if after[id] == nil || before[id] == nil {
+			return -1
+		}
+		return int64(perSecond(after[id].RxBytes+after[id].TxBytes, before[id].RxBytes+before[id].TxBytes))
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		return rate(states[i].Config.ID) > rate(states[j].Config.ID)
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tNAME\tSTORAGE\tNET I/O\tRX RATE\tTX RATE\tPACKETS\tDROPPED\tCONNECTIONS")
+	for _, state := range states {
+		name := state.Config.Name
+		if name == "" {
+			name = "-"
+		}
+
+		// Containers without a storage size write to their rootfs
+		storage := "-"
+		if usage, err := CollectStorageStats(state.Config); err != nil {
+			logError("%v", err)
+		} else if usage != nil {
+			storage = fmt.Sprintf("%s / %s", formatBytes(usage.Used), formatBytes(usage.Size))
+		}
+
+		now, then := after[state.Config.ID], before[state.Config.ID]
+		if now == nil || then == nil {
+			// Traffic of the host's or another container's network
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\t-\t-\t-\n", shortID(state.Config.ID), name, storage)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s / %s\t%s/s\t%s/s\t%d / %d\t%d / %d\t%s\n",
+			shortID(state.Config.ID), name, storage,
+			formatBytes(now.RxBytes), formatBytes(now.TxBytes),
+			formatBytes(perSecond(now.RxBytes, then.RxBytes)), formatBytes(perSecond(now.TxBytes, then.TxBytes)),
+			now.RxPackets, now.TxPackets, now.RxDropped, now.TxDropped,
+			formatConnections(now.Connections))
+	}
+	return w.Flush()
+}
+
+func containerInspect(ref string) error {
+	state, err := FindContainer(ref)
+	if err != nil {
+		return err
+	}
+
+	stats, err := CollectNetworkStats([]*ContainerConfig{state.Config})
+	if err != nil {
+		return err
+	}
+
+	storage, err := CollectStorageStats(state.Config)
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(struct {
+		*ContainerState
+		NetworkStats *NetworkStats `json:"network_stats,omitempty"`
+		StorageStats *StorageStats `json:"storage_stats,omitempty"`
+	}{state, stats[state.Config.ID], storage}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
+
+func handleNetwork(args []string) {
+	if len(args) == 0 {
+		logError("No network command specified")
+		printUsage()
+		os.Exit(1)
+	}
+
+	var err error
+	switch args[0] {
+	case "create":
+		err = networkCreate(args[1:])
+	case "ls", "list":
+		err = networkList()
+	case "rm", "remove":
+		if len(args) < 2 {
+			err = fmt.Errorf("no network specified")
+		}
+		for _, name := range args[1:] {
+			if err = RemoveNetwork(name); err != nil {
+				break
+			}
+			fmt.Println(name)
+		}
+	case "inspect":
+		if len(args) < 2 {
+			err = fmt.Errorf("no network specified")
+		} else {
+			err = networkInspect(args[1])
+		}
+	default:
+		err = fmt.Errorf("unknown network command: %s", args[0])
+	}
+
+	if err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+}
+
+func networkCreate(args []string) error {
+	flagSet := flag.NewFlagSet("network create", flag.ExitOnError)
+	subnet := flagSet.String("subnet", "", "Subnet in CIDR format (default: a free /24 in 172.30.0.0/16)")
+	gateway := flagSet.String("gateway", "", "Gateway address (default: first address in the subnet)")
+	ipv6Subnet := flagSet.String("ipv6-network", "", "IPv6 subnet in CIDR format, makes the network dual-stack")
+	ipv6Gateway := flagSet.String("ipv6-gateway", "", "IPv6 gateway address (default: first address in the IPv6 subnet)")
+	embeddedDNS := flagSet.Bool("embedded-dns", false, "Resolve container names and aliases with a DNS server on the gateway")
+	driver := flagSet.String("driver", driverBridge, "Network driver: bridge, macvlan or ipvlan")
+	parent := flagSet.String("parent", "", "Host interface macvlan and ipvlan networks attach to")
+	mode := flagSet.String("mode", "", "macvlan mode (bridge, private, vepa, passthru) or ipvlan mode (l2, l3, l3s)")
+	dhcp := flagSet.Bool("dhcp", false, "Lease container addresses from the LAN's DHCP server (macvlan and ipvlan only)")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: network create [--driver DRIVER] [--parent IFACE] [--mode MODE] [--dhcp] [--subnet CIDR] [--gateway IP] [--ipv6-network CIDR] [--ipv6-gateway IP] [--embedded-dns] NAME")
+	}
+
+	network, err := CreateNetwork(&Network{
+		Name:        flagSet.Arg(0),
+		Subnet:      *subnet,
+		Gateway:     *gateway,
+		IPv6Subnet:  *ipv6Subnet,
+		IPv6Gateway: *ipv6Gateway,
+		EmbeddedDNS: *embeddedDNS,
+		Driver:      *driver,
+		Parent:      *parent,
+		Mode:        *mode,
+		DHCP:        *dhcp,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(network.ID)
+	return nil
+}
+
+func networkList() error {
+	networks, err := ListNetworks()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NETWORK ID\tNAME\tDRIVER\tINTERFACE\tSUBNET\tGATEWAY\tIPV6 SUBNET")
+	for _, network := range networks {
+		iface := network.Bridge
+		if network.isLAN() {
+			iface = network.Parent
+		}
+		subnet, gateway := network.Subnet, network.Gateway
+		if network.DHCP {
+			subnet, gateway = "dhcp", "dhcp"
+		}
+		ipv6Subnet := network.IPv6Subnet
+		if ipv6Subnet == "" {
+			ipv6Subnet = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", shortID(network.ID), network.Name,
+			network.driver(), iface, subnet, gateway, ipv6Subnet)
+	}
+	return w.Flush()
+}
+
+func networkInspect(name string) error {
+	network, err := LoadNetwork(name)
+	if err != nil {
+		return err
+	}
+
+	containers, err := NetworkContainers(network)
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(struct {
+		*Network
+		Containers []NetworkContainer `json:"containers"`
+	}{network, containers}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
+
+func handleVolume(args []string) {
+	if len(args) == 0 {
+		logError("No volume command specified")
+		printUsage()
+		os.Exit(1)
+	}
+
+	var err error
+	switch args[0] {
+	case "create":
+		err = volumeCreate(args[1:])
+	case "ls", "list":
+		err = volumeList()
+	case "rm", "remove":
+		if len(args) < 2 {
+			err = fmt.Errorf("no volume specified")
+		}
+		for _, name := range args[1:] {
+			if err = RemoveVolume(name); err != nil {
+				break
+			}
+			fmt.Println(name)
+		}
+	case "inspect":
+		if len(args) < 2 {
+			err = fmt.Errorf("no volume specified")
+		} else {
+			err = volumeInspect(args[1])
+		}
+	case "prune":
+		var removed []string
+		removed, err = PruneVolumes()
+		for _, name := range removed {
+			fmt.Println(name)
+		}
+	default:
+		err = fmt.Errorf("unknown volume command: %s", args[0])
+	}
+
+	if err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+}
+
+func volumeCreate(args []string) error {
+	flagSet := flag.NewFlagSet("volume create", flag.ExitOnError)
+	size := flagSet.String("size", "", "Quota such as 500m or 10g, backed by a loop-mounted ext4 image (default: unlimited)")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: volume create [--size SIZE] NAME")
+	}
+
+	var bytes uint64
+	if *size != "" {
+		var err error
+		if bytes, err = parseSize(*size); err != nil {
+			return err
+		}
+	}
+
+	volume, err := CreateVolume(flagSet.Arg(0), bytes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(volume.Name)
+	return nil
+}
+
+func volumeList() error {
+	volumes, err := ListVolumes()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "VOLUME NAME\tSIZE\tUSED\tCONTAINERS")
+	for _, volume := range volumes {
+		size := "-"
+		if volume.Size > 0 {
+			size = formatBytes(volume.Size)
+		}
+		used, err := volume.usage()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", volume.Name, size, formatBytes(used), len(volume.users()))
+	}
+	return w.Flush()
+}
+
+func volumeInspect(name string) error {
+	volume, err := LoadVolume(name)
+	if err != nil {
+		return err
+	}
+
+	used, err := volume.usage()
+	if err != nil {
+		return err
+	}
+
+	containers := volume.users()
+	if containers == nil {
+		containers = []string{}
+	}
+
+	out, err := json.MarshalIndent(struct {
+		*Volume
+		Mountpoint string   `json:"mountpoint"`
+		Used       uint64   `json:"used"`
+		Containers []string `json:"containers"`
+	}{volume, volumePath(name), used, containers}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
+
 func printUsage() {
 	fmt.Printf(`Container Runtime - A simple Linux container implementation
 
 Usage: %s [OPTIONS] COMMAND [ARG...]
 
 Commands:
-  run    Run a command in a new container
-  help   Show this help message
+  run       Run a command in a new container
+  network   Manage networks (create, ls, rm, inspect)
+  volume    Manage named volumes (create, ls, rm, inspect, prune)
+  update    Change the network shaping of a running container
+  stats     Show network traffic and storage usage of running containers, busiest first
+  inspect   Show a running container's configuration and network counters as JSON
+  cp        Copy files between a container and the host (cp CONTAINER:SRC DEST, cp SRC CONTAINER:DEST)
+  diff      List the paths a container added (A), changed (C) or deleted (D) in its rootfs
+  export    Write a container's root filesystem as a tar archive (export CONTAINER [-o FILE])
+  import    Unpack a tar archive into a new rootfs directory (import FILE|- DIRECTORY)
+  rootfs    Build a minimal rootfs from host executables (rootfs create DIR --from-host-binaries sh,ls)
+  help      Show this help message
 
 Options for 'run' command:
+  --name NAME               Container name, must be unique among running containers
   --hostname HOSTNAME        Set container hostname (default: container)
   --rootfs PATH             Path to container root filesystem (default: ./namespace_fs)
-  --network CIDR            Container network CIDR (default: 192.168.1.0/24)
-  --host-ip IP              Host IP address (default: 192.168.1.1)
-  --container-ip IP         Container IP address (default: 192.168.1.2)
-  --mount HOST:CONTAINER[:ro] Bind mount host directory to container
+  --network NAME            Network to attach to (default: bridge, 192.168.1.0/24)
+                            none: loopback only, host: share the host's network,
+                            container:ID: share another container's network
+  --network-alias ALIAS     Extra name on the network, can be specified multiple times
+  --container-ip IP         Container IP address (default: next free address)
+  --ipv6 IP                 Container IPv6 address on a dual-stack network (default: next free address)
+  --egress-iface IFACE      Host interface for outbound NAT (default: default route's interface)
+  -p, --publish [IP:]HOST:CONTAINER[/PROTO]
+                            Publish a container port on the host (tcp or udp)
+                            Can be specified multiple times
+  --mount HOST:CONTAINER[:OPTIONS]
+                            Bind mount host directory to container
+                            Options: ro, nosuid, nodev, noexec, rslave, ...
+  --mount type=bind|tmpfs|volume,source=SRC,target=DST[,readonly][,...]
+                            Fields: bind-recursive, bind-propagation,
+                            tmpfs-size, tmpfs-mode, options=nosuid,nodev,
+                            idmap=CONTAINER_ID:HOST_ID:COUNT
+                            Mount flags can be specified multiple times
+  -v, --volume SPEC         Same as --mount
+  --tmpfs PATH[:OPTIONS]    Mount a tmpfs, options such as size=64m,mode=1777,noexec
                             Can be specified multiple times
-                            Add :ro for read-only mounts
+  --storage-size SIZE       Write to a layer of this size over the rootfs instead of
+                            the rootfs itself, discarded on exit, e.g. 10g
+  --read-only               Mount the root filesystem read-only, /tmp, /run, /var/tmp
+                            and --tmpfs paths get a writable tmpfs
+  --device HOST[:CONTAINER][:rwm]
+                            Pass a host device to the container, with read, write and
+                            mknod access by default. Can be specified multiple times
+  --shm-size SIZE           Size of /dev/shm (default: 64m)
+  --writable-sys            Mount /sys and /sys/fs/cgroup read-write (default: read-only)
+  --add-host NAME:IP        Add an entry to /etc/hosts, can be specified multiple times
+  --dns IP                  Nameserver for the container (default: the host's)
+  --dns-search DOMAIN       DNS search domain (default: the host's)
+  --dns-option OPTION       resolv.conf option, e.g. ndots:2 (default: the host's)
+                            DNS flags can be specified multiple times
+  --network-rate RATE       Limit bandwidth in each direction, e.g. 10mbit
+  --network-delay DURATION  Add latency in each direction, e.g. 100ms
+  --network-loss PERCENT    Drop a share of packets in each direction, e.g. 1%%
+  --deny-egress             Drop outbound traffic except replies, the container's network
+                            and its DNS server, logging drops to the kernel log
+  --allow-egress HOST[:PORT][/PROTO]
+                            Allow an address, CIDR, hostname or * despite --deny-egress,
+                            implies --deny-egress. Can be specified multiple times
+
+Options for 'update' command:
+  --network-rate RATE       New bandwidth limit, 0 removes it
+  --network-delay DURATION  New latency, 0 removes it
+  --network-loss PERCENT    New packet loss, 0 removes it
+
+Options for 'stats' command:
+  --interval DURATION       How long to measure the current rates for (default: 1s)
+
+Options for 'network create' command:
+  --subnet CIDR             Subnet for the network (default: free /24 in 172.30.0.0/16)
+  --gateway IP              Gateway address on the bridge (default: first address)
+  --ipv6-network CIDR       IPv6 subnet, makes the network dual-stack
+  --ipv6-gateway IP         IPv6 gateway address on the bridge (default: first address)
+  --embedded-dns            Resolve container names and aliases with a DNS server on the gateway
+  --driver DRIVER           bridge, macvlan or ipvlan (default: bridge)
+  --parent IFACE            Host interface macvlan and ipvlan networks attach to
+  --mode MODE               macvlan: bridge, private, vepa, passthru (default: bridge)
+                            ipvlan: l2, l3, l3s (default: l2)
+  --dhcp                    Lease container addresses from the LAN's DHCP server
+                            instead of --subnet (macvlan and ipvlan only)
+
+Options for 'volume create' command:
+  --size SIZE               Quota such as 500m or 10g, backed by a loop-mounted ext4 image
+                            (default: unlimited)
 
 Examples:
+  # Build a rootfs from the host's shell and tools, no network needed
+  sudo %s rootfs create ./namespace_fs --from-host-binaries sh,ls,cat,ps
+
   # Run bash in a container with current directory mounted to /app
   sudo %s run /bin/bash
 
   # Run with custom mounts
   sudo %s run --mount /home/user/code:/app --mount /tmp:/tmp:ro /bin/bash
 
-  # Run with custom hostname and network
-  sudo %s run --hostname mycontainer --network 10.0.0.0/24 /bin/sh
+  # A database volume that can't fill up the host's disk
+  sudo %s volume create --size 10g pgdata
+  sudo %s run --mount type=volume,source=pgdata,target=/var/lib/postgresql /bin/sh
+
+  # Scratch space in memory and a named volume that outlives the container
+  sudo %s run --mount type=tmpfs,target=/tmp,tmpfs-size=64m -v type=volume,source=cache,target=/cache /bin/sh
+
+  # An immutable container with a small writable cache
+  sudo %s run --read-only --tmpfs /var/cache/app:size=100m /bin/sh
+
+  # Pull a build artifact out of a container and drop a config file in
+  sudo %s cp builder:/src/out/app ./app
+  sudo %s cp ./app.conf builder:/etc/app.conf
+
+  # Snapshot a configured container as the rootfs of new ones
+  sudo %s export builder -o builder.tar
+  sudo %s import builder.tar ./builder_fs
+
+  # Use FUSE filesystems inside the container
+  sudo %s run --device /dev/fuse --shm-size 256m /bin/sh
+
+  # Publish port 80 of the container on port 8080 of the host
+  sudo %s run -p 8080:80 -p 127.0.0.1:5353:53/udp /bin/sh
+
+  # Debug a running container from a sidecar sharing its network
+  sudo %s run --network container:f66f84f5 /bin/sh
+
+  # Run with custom hostname on a user-defined network
+  sudo %s network create --subnet 10.0.0.0/24 backend
+  sudo %s run --hostname mycontainer --network backend /bin/sh
+
+  # Dual-stack network with IPv6 addresses and NAT
+  sudo %s network create --ipv6-network fd00:10::/64 dualstack
+  sudo %s run --network dualstack /bin/sh
+
+  # Put a container on the physical LAN with an address from its DHCP server
+  sudo %s network create --driver macvlan --parent eth0 --dhcp lan
+  sudo %s run --network lan /bin/sh
+
+  # Only allow HTTPS to the package mirror and the build cache network
+  sudo %s run --allow-egress pypi.org:443/tcp --allow-egress 10.20.0.0/16 /bin/sh
+
+  # Find the container saturating the link
+  sudo %s stats
+
+  # Simulate a slow link, then lift the bandwidth limit
+  sudo %s run --name slow --network-rate 1mbit --network-delay 100ms /bin/sh
+  sudo %s update --network-rate 0 slow
 
 Environment Variables:
   DEBUG=1                   Enable debug output
+  FIREWALL_BACKEND=NAME     Force the nftables or iptables firewall backend
 
 Notes:
   - This program must be run as root
   - The rootfs directory must exist and contain a basic Linux filesystem
-  - iptables is required for network functionality
+  - nftables (or the iptables binary as a fallback) is required for networking
   - The container will have network access through NAT
+  - Containers on different networks cannot reach each other
+  - Ports published on localhost are only reachable through 127.0.0.1, not ::1
+  - The host cannot reach containers on its own macvlan or ipvlan networks
 
-`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+		os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 
 func printVersion() {
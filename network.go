@@ -2,16 +2,199 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
+// containerIface is the name of the container's interface inside its namespace
+const containerIface = "eth0"
+
+// Network modes accepted by --network in place of a network name
+const (
+	networkNone            = "none"       // Own namespace with only loopback
+	networkHost            = "host"       // Share the host's network namespace
+	networkContainerPrefix = "container:" // Share another container's namespace
+)
+
+// sharedNetworkContainer returns the container referenced by a
+// container:<id> network mode
+func sharedNetworkContainer(network string) (string, bool) {
+	if !strings.HasPrefix(network, networkContainerPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(network, networkContainerPrefix), true
+}
+
+// attachedToNetwork reports whether the container gets its own interface and
+// address on a user-defined network
+func attachedToNetwork(config *ContainerConfig) bool {
+	_, shared := sharedNetworkContainer(config.Network)
+	return !shared && config.Network != networkNone && config.Network != networkHost
+}
+
+// usesBridge reports whether the container gets its own veth and address on a bridge network.
+// The driver is only known once the network is allocated, until then every network counts.
+func usesBridge(config *ContainerConfig) bool {
+	return attachedToNetwork(config) && !usesLAN(config)
+}
+
+// usesLAN reports whether the container sits directly on a LAN through a
+// macvlan or ipvlan interface
+func usesLAN(config *ContainerConfig) bool {
+	_, lan := lanDriverModes[config.Driver]
+	return lan
+}
+
+// needsNetworkNamespace reports whether the container is started in a new network namespace
+func needsNetworkNamespace(config *ContainerConfig) bool {
+	_, shared := sharedNetworkContainer(config.Network)
+	return !shared && config.Network != networkHost
+}
+
+// AllocateNetwork resolves the container's network and reserves its address
+// before it starts, so the address is known to both the parent and the child process
+func AllocateNetwork(config *ContainerConfig) error {
+	if ref, shared := sharedNetworkContainer(config.Network); shared {
+		target, err := FindContainer(ref)
+		if err != nil {
+			return err
+		}
+
+		// Normalize the reference and report the address we'll be sharing
+		config.Network = networkContainerPrefix + target.Config.ID
+		config.NetworkCIDR = target.Config.NetworkCIDR
+		config.HostIP = target.Config.HostIP
+		config.ContainerIP = target.Config.ContainerIP
+		config.IPv6CIDR = target.Config.IPv6CIDR
+		config.IPv6Gateway = target.Config.IPv6Gateway
+		config.ContainerIPv6 = target.Config.ContainerIPv6
+		config.EmbeddedDNS = target.Config.EmbeddedDNS
+		config.DHCPLease = target.Config.DHCPLease
+		return nil
+	}
+
+	if !attachedToNetwork(config) {
+		return nil
+	}
+
+	network, err := LoadNetwork(config.Network)
+	if err != nil {
+		return err
+	}
+
+	// Without a bridge there is no NAT, no firewall and no veth to shape
+	if network.isLAN() && (len(config.Ports) > 0 || config.Shaping.Enabled() || config.DenyEgress) {
+		return fmt.Errorf("--publish, network shaping and egress policies require a bridge network, %s attaches containers to the LAN directly", network.Name)
+	}
+	if err := ReservePorts(config); err != nil {
+		return err
+	}
+
+	config.Driver = network.driver()
+	if network.DHCP {
+		if config.ContainerIP != "" || config.ContainerIPv6 != "" {
+			return fmt.Errorf("network %s leases addresses with DHCP, --container-ip and --ipv6 can't be used", network.Name)
+		}
+		// The address is leased once the container's interface exists
+		return nil
+	}
+
+	config.Bridge = network.Bridge
+	config.NetworkCIDR = network.Subnet
+	config.HostIP = network.Gateway
+	if network.EmbeddedDNS {
+		config.EmbeddedDNS = network.Gateway
+	}
+
+	ip, err := AllocateIP(network.Name, network.Subnet, network.Gateway, config.ID, config.ContainerIP)
+	if err != nil {
+		ReleasePorts(config.ID)
+		return fmt.Errorf("failed to allocate IP address on network %s: %v", network.Name, err)
+	}
+
+	config.ContainerIP = ip.String()
+
+	if network.IPv6Subnet == "" {
+		if config.ContainerIPv6 != "" {
+			ReleaseIP(network.Name, config.ID)
+			ReleasePorts(config.ID)
+			return fmt.Errorf("network %s has no IPv6 subnet, create one with --ipv6-network", network.Name)
+		}
+		return nil
+	}
+
+	config.IPv6CIDR = network.IPv6Subnet
+	config.IPv6Gateway = network.IPv6Gateway
+
+	ip, err = AllocateIP(ipv6Pool(network.Name), network.IPv6Subnet, network.IPv6Gateway, config.ID, config.ContainerIPv6)
+	if err != nil {
+		ReleaseIP(network.Name, config.ID)
+		ReleasePorts(config.ID)
+		return fmt.Errorf("failed to allocate IPv6 address on network %s: %v", network.Name, err)
+	}
+
+	config.ContainerIPv6 = ip.String()
+	return nil
+}
+
+// StartInNetwork starts the container process. With container:<id> the process
+// is forked from a thread inside the target's network namespace, so it inherits it.
+func StartInNetwork(cmd *exec.Cmd, config *ContainerConfig) error {
+	ref, shared := sharedNetworkContainer(config.Network)
+	if !shared {
+		return cmd.Start()
+	}
+
+	target, err := FindContainer(ref)
+	if err != nil {
+		return err
+	}
+
+	runtime.LockOSThread() // Required for network namespace operations
+	defer runtime.UnlockOSThread()
+
+	hostNs, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("failed to get host namespace: %v", err)
+	}
+	defer hostNs.Close()
+
+	targetNs, err := netns.GetFromPid(target.PID)
+	if err != nil {
+		return fmt.Errorf("failed to get namespace of container %s: %v", shortID(target.Config.ID), err)
+	}
+	defer targetNs.Close()
+
+	if err := netns.Set(targetNs); err != nil {
+		return fmt.Errorf("failed to enter namespace of container %s: %v", shortID(target.Config.ID), err)
+	}
+	startErr := cmd.Start()
+
+	if err := netns.Set(hostNs); err != nil {
+		// This thread can't be trusted any more, don't unlock it so it exits with the goroutine
+		runtime.LockOSThread()
+		return fmt.Errorf("failed to switch back to host namespace: %v", err)
+	}
+
+	return startErr
+}
+
 // SetupNetworking configures the container's network
 func SetupNetworking(pid int, config *ContainerConfig) error {
+	if !needsNetworkNamespace(config) {
+		return nil
+	}
+
 	runtime.LockOSThread() // Required for network namespace operations
 	defer runtime.UnlockOSThread()
 
@@ -28,8 +211,26 @@ func SetupNetworking(pid int, config *ContainerConfig) error {
 	}
 	defer containerNs.Close()
 
-	// Create veth pair
-	if err := createVethPair(); err != nil {
+	// Without a network only loopback is configured, leaving the host untouched
+	if config.Network == networkNone {
+		if err := netns.Set(containerNs); err != nil {
+			return fmt.Errorf("failed to switch to container namespace: %v", err)
+		}
+		err := bringUpLoopback()
+		if setErr := netns.Set(hostNs); setErr != nil {
+			return fmt.Errorf("failed to switch back to host namespace: %v", setErr)
+		}
+		return err
+	}
+
+	// LAN networks move a sub-interface of the parent into the container instead
+	if usesLAN(config) {
+		return setupLANNetworking(config, hostNs, containerNs)
+	}
+
+	// Create veth pair with names unique to this container
+	config.HostVeth, config.PeerVeth = vethNames(config.ID)
+	if err := createVethPair(config.HostVeth, config.PeerVeth); err != nil {
 		return fmt.Errorf("failed to create veth pair: %v", err)
 	}
 
@@ -38,14 +239,53 @@ func SetupNetworking(pid int, config *ContainerConfig) error {
 		return fmt.Errorf("failed to configure host network: %v", err)
 	}
 
-	// Move veth1 to container namespace
-	veth1, err := netlink.LinkByName("veth1")
+	// Setup forwarding rules shared by the network
+	network, err := LoadNetwork(config.Network)
+	if err != nil {
+		return err
+	}
+
+	config.EgressIfaces, err = egressInterfaces(config.EgressIface, netlink.FAMILY_V4)
 	if err != nil {
-		return fmt.Errorf("failed to get veth1: %v", err)
+		return err
+	}
+
+	if config.ContainerIPv6 != "" {
+		config.EgressIfacesV6, err = egressInterfaces(config.EgressIface, netlink.FAMILY_V6)
+		if err != nil {
+			// Containers can still reach each other and the host over IPv6
+			logInfo("IPv6 traffic won't leave the host: %v", err)
+		}
+	}
+
+	if err := enableForwarding(config); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding: %v", err)
+	}
+
+	if err := setupNetworkRules(network); err != nil {
+		return fmt.Errorf("failed to setup forwarding: %v", err)
+	}
+
+	// Setup NAT through the host's egress interfaces, publish ports and
+	// enforce the egress policy, before the container's interface comes up
+	if config.DenyEgress {
+		if err := resolveEgressRules(config); err != nil {
+			return err
+		}
 	}
 
-	if err := netlink.LinkSetNsFd(veth1, int(containerNs)); err != nil {
-		return fmt.Errorf("failed to move veth1 to container: %v", err)
+	if err := setupContainerRules(config); err != nil {
+		return fmt.Errorf("failed to setup container firewall rules: %v", err)
+	}
+
+	// Move the peer to container namespace
+	peer, err := netlink.LinkByName(config.PeerVeth)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %v", config.PeerVeth, err)
+	}
+
+	if err := netlink.LinkSetNsFd(peer, int(containerNs)); err != nil {
+		return fmt.Errorf("failed to move %s to container: %v", config.PeerVeth, err)
 	}
 
 	// Switch to container namespace and configure
@@ -64,19 +304,30 @@ func SetupNetworking(pid int, config *ContainerConfig) error {
 		return fmt.Errorf("failed to switch back to host namespace: %v", err)
 	}
 
-	// Setup NAT and forwarding rules
-	if err := setupNAT(config); err != nil {
-		return fmt.Errorf("failed to setup NAT: %v", err)
+	if config.Shaping.Enabled() {
+		if err := ApplyShaping(config); err != nil {
+			return fmt.Errorf("failed to setup network shaping: %v", err)
+		}
 	}
 
 	return nil
 }
 
+// vethNames derives the host and peer interface names from the container ID.
+// Interface names are limited to 15 characters, so only the short ID is used.
+func vethNames(id string) (string, string) {
+	suffix := shortID(id)
+	if len(suffix) > 8 {
+		suffix = suffix[:8]
+	}
+	return "veth" + suffix, "ceth" + suffix
+}
+
 // createVethPair creates a virtual ethernet pair
-func createVethPair() error {
+func createVethPair(hostName, peerName string) error {
 	veth := &netlink.Veth{
-		LinkAttrs: netlink.LinkAttrs{Name: "veth0"},
-		PeerName:  "veth1",
+		LinkAttrs: netlink.LinkAttrs{Name: hostName},
+		PeerName:  peerName,
 	}
 	
 	if err := netlink.LinkAdd(veth); err != nil {
@@ -86,55 +337,146 @@ func createVethPair() error {
 	return nil
 }
 
-// configureHostNetwork configures the host side of the veth pair
+// configureHostNetwork attaches the host side of the veth pair to the bridge
 func configureHostNetwork(config *ContainerConfig) error {
-	veth0, err := netlink.LinkByName("veth0")
+	bridge, err := ensureBridge(config.Bridge, config.HostIP, config.NetworkCIDR)
+	if err != nil {
+		return err
+	}
+
+	if config.IPv6Gateway != "" {
+		if err := addGatewayAddr(bridge, config.IPv6Gateway, config.IPv6CIDR); err != nil {
+			return err
+		}
+	}
+
+	hostVeth, err := netlink.LinkByName(config.HostVeth)
 	if err != nil {
-		return fmt.Errorf("failed to get veth0: %v", err)
+		return fmt.Errorf("failed to get %s: %v", config.HostVeth, err)
+	}
+
+	if err := netlink.LinkSetMaster(hostVeth, bridge); err != nil {
+		return fmt.Errorf("failed to attach %s to %s: %v", config.HostVeth, config.Bridge, err)
 	}
 
 	// Bring up the interface
-	if err := netlink.LinkSetUp(veth0); err != nil {
-		return fmt.Errorf("failed to bring up veth0: %v", err)
+	if err := netlink.LinkSetUp(hostVeth); err != nil {
+		return fmt.Errorf("failed to bring up %s: %v", config.HostVeth, err)
 	}
 
-	// Parse and assign IP address
-	hostIP := net.ParseIP(config.HostIP)
-	if hostIP == nil {
-		return fmt.Errorf("invalid host IP: %s", config.HostIP)
+	return nil
+}
+
+// ensureBridge returns the named bridge, creating it with the gateway address
+// if it doesn't exist yet. The bridge is shared by every container on the network.
+func ensureBridge(name, gatewayIP, networkCIDR string) (netlink.Link, error) {
+	bridge, err := netlink.LinkByName(name)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create bridge %s: %v", name, err)
+		}
+		bridge, err = netlink.LinkByName(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bridge %s: %v", name, err)
+	}
+
+	if bridge.Type() != "bridge" {
+		return nil, fmt.Errorf("%s exists but is a %s, not a bridge", name, bridge.Type())
+	}
+
+	if err := addGatewayAddr(bridge, gatewayIP, networkCIDR); err != nil {
+		return nil, err
 	}
 
-	_, hostNet, err := net.ParseCIDR(config.NetworkCIDR)
+	if err := netlink.LinkSetUp(bridge); err != nil {
+		return nil, fmt.Errorf("failed to bring up %s: %v", name, err)
+	}
+
+	return bridge, nil
+}
+
+// addGatewayAddr assigns the gateway address to the bridge unless a previous
+// container already did
+func addGatewayAddr(bridge netlink.Link, gatewayIP, networkCIDR string) error {
+	name := bridge.Attrs().Name
+
+	gateway := net.ParseIP(gatewayIP)
+	if gateway == nil {
+		return fmt.Errorf("invalid gateway IP: %s", gatewayIP)
+	}
+
+	_, ipNet, err := net.ParseCIDR(networkCIDR)
 	if err != nil {
-		return fmt.Errorf("invalid network CIDR: %s", config.NetworkCIDR)
+		return fmt.Errorf("invalid network CIDR: %s", networkCIDR)
+	}
+
+	addrs, err := netlink.AddrList(bridge, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses on %s: %v", name, err)
+	}
+
+	for _, addr := range addrs {
+		if addr.IP.Equal(gateway) {
+			return nil
+		}
 	}
 
-	hostCIDR := &net.IPNet{IP: hostIP, Mask: hostNet.Mask}
-	if err := netlink.AddrAdd(veth0, &netlink.Addr{IPNet: hostCIDR}); err != nil {
-		return fmt.Errorf("failed to add address to veth0: %v", err)
+	if err := netlink.AddrAdd(bridge, newAddr(gateway, ipNet.Mask)); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to add address to %s: %v", name, err)
 	}
 
 	return nil
 }
 
+// newAddr builds an interface address. IPv6 addresses skip duplicate address
+// detection, the network's IPAM already guarantees they are unique and
+// waiting for DAD would leave them unusable while the container starts.
+func newAddr(ip net.IP, mask net.IPMask) *netlink.Addr {
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: mask}}
+	if ip.To4() == nil {
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	return addr
+}
+
 // configureContainerNetwork configures the container side of the veth pair
 func configureContainerNetwork(config *ContainerConfig) error {
+	eth0, err := bringUpContainerIface(config)
+	if err != nil {
+		return err
+	}
+
+	return addContainerAddresses(eth0, config)
+}
+
+// bringUpContainerIface brings up loopback and the container's interface,
+// renamed to eth0 now that it is inside the container namespace
+func bringUpContainerIface(config *ContainerConfig) (netlink.Link, error) {
 	// Bring up loopback interface
 	if err := bringUpLoopback(); err != nil {
-		return fmt.Errorf("failed to bring up loopback: %v", err)
+		return nil, fmt.Errorf("failed to bring up loopback: %v", err)
 	}
 
-	// Configure veth1
-	veth1, err := netlink.LinkByName("veth1")
+	eth0, err := netlink.LinkByName(config.PeerVeth)
 	if err != nil {
-		return fmt.Errorf("failed to get veth1: %v", err)
+		return nil, fmt.Errorf("failed to get %s: %v", config.PeerVeth, err)
+	}
+
+	if err := netlink.LinkSetName(eth0, containerIface); err != nil {
+		return nil, fmt.Errorf("failed to rename %s to %s: %v", config.PeerVeth, containerIface, err)
 	}
 
 	// Bring up the interface
-	if err := netlink.LinkSetUp(veth1); err != nil {
-		return fmt.Errorf("failed to bring up veth1: %v", err)
+	if err := netlink.LinkSetUp(eth0); err != nil {
+		return nil, fmt.Errorf("failed to bring up %s: %v", containerIface, err)
 	}
 
+	return eth0, nil
+}
+
+// addContainerAddresses assigns the container's addresses and default routes
+func addContainerAddresses(eth0 netlink.Link, config *ContainerConfig) error {
 	// Parse and assign IP address
 	containerIP := net.ParseIP(config.ContainerIP)
 	if containerIP == nil {
@@ -146,18 +488,46 @@ func configureContainerNetwork(config *ContainerConfig) error {
 		return fmt.Errorf("invalid network CIDR: %s", config.NetworkCIDR)
 	}
 
-	containerCIDR := &net.IPNet{IP: containerIP, Mask: containerNet.Mask}
-	if err := netlink.AddrAdd(veth1, &netlink.Addr{IPNet: containerCIDR}); err != nil {
-		return fmt.Errorf("failed to add address to veth1: %v", err)
+	if err := netlink.AddrAdd(eth0, newAddr(containerIP, containerNet.Mask)); err != nil {
+		return fmt.Errorf("failed to add address to %s: %v", containerIface, err)
 	}
 
-	// Add default route
+	// Add default route, unless a DHCP server didn't offer a router
 	route := &netlink.Route{
-		LinkIndex: veth1.Attrs().Index,
+		LinkIndex: eth0.Attrs().Index,
 		Gw:        net.ParseIP(config.HostIP),
 	}
+	if config.HostIP != "" {
+		if err := netlink.RouteAdd(route); err != nil {
+			return fmt.Errorf("failed to add default route: %v", err)
+		}
+	}
+
+	if config.ContainerIPv6 == "" {
+		return nil
+	}
+
+	// Dual-stack networks also get an IPv6 address and default route
+	containerIPv6 := net.ParseIP(config.ContainerIPv6)
+	if containerIPv6 == nil {
+		return fmt.Errorf("invalid container IPv6 address: %s", config.ContainerIPv6)
+	}
+
+	_, ipv6Net, err := net.ParseCIDR(config.IPv6CIDR)
+	if err != nil {
+		return fmt.Errorf("invalid IPv6 network CIDR: %s", config.IPv6CIDR)
+	}
+
+	if err := netlink.AddrAdd(eth0, newAddr(containerIPv6, ipv6Net.Mask)); err != nil {
+		return fmt.Errorf("failed to add IPv6 address to %s: %v", containerIface, err)
+	}
+
+	route = &netlink.Route{
+		LinkIndex: eth0.Attrs().Index,
+		Gw:        net.ParseIP(config.IPv6Gateway),
+	}
 	if err := netlink.RouteAdd(route); err != nil {
-		return fmt.Errorf("failed to add default route: %v", err)
+		return fmt.Errorf("failed to add IPv6 default route: %v", err)
 	}
 
 	return nil
@@ -177,48 +547,361 @@ func bringUpLoopback() error {
 	return nil
 }
 
-// setupNAT configures NAT and forwarding rules for container internet access
-func setupNAT(config *ContainerConfig) error {
-	_, network, err := net.ParseCIDR(config.NetworkCIDR)
+// networkRules returns the firewall rules that let a network forward traffic
+// and keep it isolated from other container networks
+func networkRules(network *Network) []FirewallRule {
+	otherBridges := bridgePrefix + "+"
+	return []FirewallRule{
+		// Allow traffic between containers on the same network
+		{Chain: chainForward, InIface: network.Bridge, OutIface: network.Bridge, Action: actionAccept},
+		// Allow forwarding to and from anything that isn't another container network
+		{Chain: chainForward, InIface: network.Bridge, OutIface: "!" + otherBridges, Action: actionAccept},
+		{Chain: chainForward, InIface: "!" + otherBridges, OutIface: network.Bridge, Action: actionAccept},
+		// Drop traffic towards other container networks
+		{Chain: chainForward, InIface: network.Bridge, OutIface: otherBridges, Action: actionDrop},
+	}
+}
+
+// setupNetworkRules installs the forwarding rules shared by all containers on
+// the network, replacing any left from a previous run
+func setupNetworkRules(network *Network) error {
+	firewall, err := NewFirewall()
 	if err != nil {
-		return fmt.Errorf("invalid network CIDR: %s", config.NetworkCIDR)
+		return err
 	}
-	
-	networkStr := network.String()
-	
-	// Enable masquerading for the container network
-	cmd := exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", 
-		"-s", networkStr, "-o", "eth0", "-j", "MASQUERADE")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to setup masquerading: %v", err)
+
+	return firewall.Apply(networkOwner(network), networkRules(network))
+}
+
+// cleanupNetworkRules removes a network's forwarding rules
+func cleanupNetworkRules(network *Network) error {
+	firewall, err := NewFirewall()
+	if err != nil {
+		return err
 	}
 
-	// Allow forwarding for the container network
-	cmd = exec.Command("iptables", "-A", "FORWARD", "-s", networkStr, "-j", "ACCEPT")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to setup forward rule (outbound): %v", err)
+	return firewall.Remove(networkOwner(network))
+}
+
+// containerRules returns the firewall rules owned by a single container:
+// masquerading out of the egress interfaces, its published ports and its
+// egress policy
+func containerRules(config *ContainerConfig) []FirewallRule {
+	var rules []FirewallRule
+	for _, iface := range config.EgressIfaces {
+		rules = append(rules, FirewallRule{Chain: chainPostrouting,
+			Src: config.ContainerIP, OutIface: iface, Action: actionMasquerade})
+	}
+	for _, iface := range config.EgressIfacesV6 {
+		rules = append(rules, FirewallRule{Chain: chainPostrouting,
+			Src: config.ContainerIPv6, OutIface: iface, Action: actionMasquerade})
+	}
+
+	for _, port := range config.Ports {
+		for _, target := range portTargets(config, port) {
+			dnat := FirewallRule{
+				Proto:  port.Protocol,
+				DPort:  port.HostPort,
+				Action: actionDNAT,
+				ToAddr: target,
+				ToPort: port.ContainerPort,
+			}
+
+			// Match either the requested host address or any local address
+			if port.HostIP != "" {
+				dnat.Dst = port.HostIP
+			} else {
+				dnat.DstLocal = true
+			}
+
+			// Traffic arriving from other hosts
+			prerouting := dnat
+			prerouting.Chain = chainPrerouting
+
+			// Traffic from the host itself, including localhost
+			output := dnat
+			output.Chain = chainOutput
+
+			rules = append(rules, prerouting, output,
+				// Hairpin: the container reaching itself through the published port
+				FirewallRule{Chain: chainPostrouting, Src: target, Dst: target,
+					Proto: port.Protocol, DPort: port.ContainerPort, Action: actionMasquerade},
+			)
+
+			// Replies to localhost connections must come back through the host.
+			// IPv6 never routes ::1 off the host, so there is nothing to do for it.
+			if target == config.ContainerIP {
+				rules = append(rules, FirewallRule{Chain: chainPostrouting, Src: "127.0.0.0/8", Dst: target,
+					Proto: port.Protocol, DPort: port.ContainerPort, Action: actionMasquerade})
+			}
+		}
+	}
+	return append(rules, egressRules(config)...)
+}
+
+// portTargets returns the container addresses a published port forwards to.
+// Ports published on all host addresses reach the container over both IPv4
+// and IPv6, otherwise the host address picks the family.
+func portTargets(config *ContainerConfig, port PortMapping) []string {
+	switch {
+	case port.HostIP == "":
+		if config.ContainerIPv6 != "" {
+			return []string{config.ContainerIP, config.ContainerIPv6}
+		}
+		return []string{config.ContainerIP}
+	case net.ParseIP(port.HostIP).To4() != nil:
+		return []string{config.ContainerIP}
+	default:
+		return []string{config.ContainerIPv6}
+	}
+}
+
+// setupContainerRules installs the container's masquerade and DNAT rules
+func setupContainerRules(config *ContainerConfig) error {
+	for _, port := range config.Ports {
+		if port.HostIP != "" && net.ParseIP(port.HostIP).To4() == nil && config.ContainerIPv6 == "" {
+			return fmt.Errorf("cannot publish %s: network %s has no IPv6 subnet", port, config.Network)
+		}
 	}
 
-	cmd = exec.Command("iptables", "-A", "FORWARD", "-d", networkStr, "-j", "ACCEPT")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to setup forward rule (inbound): %v", err)
+	// Allow DNAT of localhost traffic to be routed out of the bridge
+	if len(config.Ports) > 0 {
+		if err := setSysctl(fmt.Sprintf("net/ipv4/conf/%s/route_localnet", config.Bridge), "1"); err != nil {
+			return err
+		}
 	}
 
+	firewall, err := NewFirewall()
+	if err != nil {
+		return err
+	}
+
+	logDebug("Installing firewall rules with the %s backend", firewall.Name())
+	return firewall.Apply(containerOwner(config), containerRules(config))
+}
+
+// cleanupContainerRules removes the container's masquerade and DNAT rules
+func cleanupContainerRules(config *ContainerConfig) error {
+	firewall, err := NewFirewall()
+	if err != nil {
+		return err
+	}
+
+	return firewall.Remove(containerOwner(config))
+}
+
+// egressInterfaces returns the interfaces container traffic of the given
+// family leaves the host through. An explicit override wins, otherwise every
+// interface holding a default route is used so traffic keeps flowing if the
+// host fails over.
+func egressInterfaces(override string, family int) ([]string, error) {
+	if override != "" {
+		if _, err := netlink.LinkByName(override); err != nil {
+			return nil, fmt.Errorf("egress interface %s not found: %v", override, err)
+		}
+		return []string{override}, nil
+	}
+
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	// Prefer the route the kernel would pick, i.e. the lowest metric
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].Priority < routes[j].Priority })
+
+	var ifaces []string
+	for _, route := range routes {
+		if !isDefaultRoute(route) {
+			continue
+		}
+
+		// Multipath routes carry their interfaces in the next hops
+		indexes := []int{route.LinkIndex}
+		for _, hop := range route.MultiPath {
+			indexes = append(indexes, hop.LinkIndex)
+		}
+
+		for _, index := range indexes {
+			if index == 0 {
+				continue
+			}
+			link, err := netlink.LinkByIndex(index)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get interface %d: %v", index, err)
+			}
+			ifaces = append(ifaces, link.Attrs().Name)
+		}
+	}
+
+	ifaces = unique(ifaces)
+	if len(ifaces) == 0 {
+		return nil, fmt.Errorf("no default route found, set the egress interface with --egress-iface")
+	}
+
+	return ifaces, nil
+}
+
+// isDefaultRoute reports whether the route matches every destination
+func isDefaultRoute(route netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+// forwardingStatePath records the original value of every sysctl we changed
+// to forward container traffic
+var forwardingStatePath = runtimePath("forwarding.json")
+
+// forwardingSysctls returns the sysctls the container's traffic needs and the
+// values they must have
+func forwardingSysctls(config *ContainerConfig) map[string]string {
+	sysctls := map[string]string{"net/ipv4/ip_forward": "1"}
+	if config.ContainerIPv6 == "" {
+		return sysctls
+	}
+
+	sysctls["net/ipv6/conf/all/forwarding"] = "1"
+
+	// With forwarding on, accept_ra=1 stops accepting router advertisements,
+	// which would make the host lose an autoconfigured default route
+	for _, iface := range config.EgressIfacesV6 {
+		name := fmt.Sprintf("net/ipv6/conf/%s/accept_ra", iface)
+		if current, err := ioutil.ReadFile(filepath.Join("/proc/sys", name)); err == nil && strings.TrimSpace(string(current)) == "1" {
+			sysctls[name] = "2"
+		}
+	}
+
+	return sysctls
+}
+
+// enableForwarding turns on IPv4 forwarding, and IPv6 forwarding for
+// dual-stack containers, remembering the original values so they can be
+// restored once the last container is gone
+func enableForwarding(config *ContainerConfig) error {
+	return withLockedFile(forwardingStatePath, func() error {
+		original := make(map[string]string)
+		if err := readJSONFile(forwardingStatePath, &original); err != nil {
+			return err
+		}
+
+		for name, value := range forwardingSysctls(config) {
+			current, err := ioutil.ReadFile(filepath.Join("/proc/sys", name))
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", name, err)
+			}
+
+			if strings.TrimSpace(string(current)) == value {
+				continue
+			}
+
+			// Only record the value the first time, a later container may see ours
+			if _, recorded := original[name]; !recorded {
+				original[name] = strings.TrimSpace(string(current))
+				if err := writeJSONFile(forwardingStatePath, original); err != nil {
+					return err
+				}
+			}
+
+			if err := setSysctl(name, value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// restoreForwarding puts the forwarding sysctls back to their original values
+// if we changed them and no container on the host still needs them
+func restoreForwarding() error {
+	return withLockedFile(forwardingStatePath, func() error {
+		if !fileExists(forwardingStatePath) {
+			return nil
+		}
+
+		original := make(map[string]string)
+		if err := readJSONFile(forwardingStatePath, &original); err != nil {
+			return err
+		}
+
+		networks, err := listNetworks()
+		if err != nil {
+			return err
+		}
+		for _, network := range networks {
+			containers, err := NetworkContainers(network)
+			if err != nil {
+				return err
+			}
+			if len(containers) > 0 {
+				return nil
+			}
+		}
+
+		for name, value := range original {
+			if err := setSysctl(name, value); err != nil {
+				return err
+			}
+		}
+		return os.Remove(forwardingStatePath)
+	})
+}
+
+// setSysctl writes a value under /proc/sys
+func setSysctl(name, value string) error {
+	path := filepath.Join("/proc/sys", name)
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set %s: %v", name, err)
+	}
 	return nil
 }
 
-// CleanupNetwork removes NAT and forwarding rules
+// CleanupNetwork removes the container's veth pair, NAT and published ports and
+// returns its address to the pool. The bridge and its rules are left for other containers.
 func CleanupNetwork(config *ContainerConfig) {
-	_, network, err := net.ParseCIDR(config.NetworkCIDR)
-	if err != nil {
-		return // Can't clean up if we can't parse the network
+	if !attachedToNetwork(config) {
+		return
 	}
-	
-	networkStr := network.String()
-	
-	// Remove NAT and forward rules (ignore errors as rules might not exist)
-	exec.Command("iptables", "-t", "nat", "-D", "POSTROUTING", 
-		"-s", networkStr, "-o", "eth0", "-j", "MASQUERADE").Run()
-	exec.Command("iptables", "-D", "FORWARD", "-s", networkStr, "-j", "ACCEPT").Run()
-	exec.Command("iptables", "-D", "FORWARD", "-d", networkStr, "-j", "ACCEPT").Run()
-}
\ No newline at end of file
+
+	if usesLAN(config) {
+		cleanupLANNetwork(config)
+		return
+	}
+
+	if err := cleanupContainerRules(config); err != nil {
+		logError("Failed to remove firewall rules: %v", err)
+	}
+
+	// Deleting the host side also removes the peer if the namespace still exists
+	if config.HostVeth != "" {
+		if link, err := netlink.LinkByName(config.HostVeth); err == nil {
+			netlink.LinkDel(link)
+		}
+	}
+
+	// Shaping may have been added by `update`, so always look for the ifb device
+	if err := deleteIfb(ifbName(config.ID)); err != nil {
+		logError("Failed to remove network shaping: %v", err)
+	}
+
+	if err := ReleaseIP(config.Network, config.ID); err != nil {
+		logError("Failed to release IP address: %v", err)
+	}
+
+	if config.ContainerIPv6 != "" {
+		if err := ReleaseIP(ipv6Pool(config.Network), config.ID); err != nil {
+			logError("Failed to release IPv6 address: %v", err)
+		}
+	}
+
+	if err := ReleasePorts(config.ID); err != nil {
+		logError("Failed to release published ports: %v", err)
+	}
+
+	if err := restoreForwarding(); err != nil {
+		logError("Failed to restore IP forwarding: %v", err)
+	}
+}
@@ -0,0 +1,453 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// defaultNetwork is used by containers that don't ask for a network
+	defaultNetwork = "bridge"
+
+	// bridgePrefix is shared by every bridge we create, so firewall rules can
+	// match all container networks with a single wildcard
+	bridgePrefix = "nsc"
+)
+
+// Network drivers. Bridge networks NAT containers behind a bridge on the
+// host, LAN networks attach them directly to the parent interface's LAN.
+const (
+	driverBridge  = "bridge"
+	driverMacvlan = "macvlan"
+	driverIPvlan  = "ipvlan"
+)
+
+// lanDriverModes lists the modes of each LAN driver, the first is the default
+var lanDriverModes = map[string][]string{
+	driverMacvlan: {"bridge", "private", "vepa", "passthru"},
+	driverIPvlan:  {"l2", "l3", "l3s"},
+}
+
+// validNetworkName matches the names accepted by `network create`
+var validNetworkName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Network is a user-defined container network backed by its own bridge, or
+// by sub-interfaces of a host interface for the LAN drivers
+type Network struct {
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+	Driver  string `json:"driver,omitempty"` // Empty for networks created before drivers existed
+	Bridge  string `json:"bridge,omitempty"`
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway"`
+	// IPv6 is optional, containers get an address from both subnets when it is set
+	IPv6Subnet  string `json:"ipv6_subnet,omitempty"`
+	IPv6Gateway string `json:"ipv6_gateway,omitempty"`
+	// EmbeddedDNS runs a DNS server on the gateway resolving container names
+	EmbeddedDNS bool `json:"embedded_dns,omitempty"`
+	// LAN drivers only: the host interface on the LAN, the driver's mode and
+	// whether containers lease their address from the LAN's DHCP server
+	Parent  string    `json:"parent,omitempty"`
+	Mode    string    `json:"mode,omitempty"`
+	DHCP    bool      `json:"dhcp,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// driver returns the network's driver, networks without one use bridges
+func (n *Network) driver() string {
+	if n.Driver == "" {
+		return driverBridge
+	}
+	return n.Driver
+}
+
+// isLAN reports whether containers are attached directly to the parent's LAN
+func (n *Network) isLAN() bool {
+	_, ok := lanDriverModes[n.driver()]
+	return ok
+}
+
+// NetworkContainer describes a container attached to a network
+type NetworkContainer struct {
+	ID   string `json:"id"`
+	IP   string `json:"ip"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+// networkPath returns the on-disk location of the named network
+func networkPath(name string) string {
+	return runtimePath("networks", name+".json")
+}
+
+// ipv6Pool returns the name of the IPAM pool holding a network's IPv6 addresses
+func ipv6Pool(name string) string {
+	return filepath.Join("v6", name)
+}
+
+// defaultNetworkConfig describes the network used when none is specified
+func defaultNetworkConfig() *Network {
+	return &Network{
+		Name:    defaultNetwork,
+		ID:      generateID(),
+		Driver:  driverBridge,
+		Bridge:  bridgePrefix + "0",
+		Subnet:  "192.168.1.0/24",
+		Gateway: "192.168.1.1",
+	}
+}
+
+// CreateNetwork defines a new network from the name, addressing and options
+// in spec. An empty subnet picks a free /24 from 172.30.0.0/16, and an empty
+// gateway uses the first address in the subnet. The network is dual-stack
+// when an IPv6 subnet is set. LAN networks use the LAN's subnet, or no subnet
+// at all with DHCP.
+func CreateNetwork(spec *Network) (*Network, error) {
+	name := spec.Name
+	if !validNetworkName.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name %q", name)
+	}
+	if name == networkNone || name == networkHost {
+		return nil, fmt.Errorf("%s is a reserved network name", name)
+	}
+
+	network := new(Network)
+	*network = *spec
+	network.ID = generateID()
+	network.Driver = network.driver()
+	switch {
+	case network.isLAN():
+		if err := validateLANNetwork(network); err != nil {
+			return nil, err
+		}
+	case network.Driver != driverBridge:
+		return nil, fmt.Errorf("unknown network driver %q, expected bridge, macvlan or ipvlan", network.Driver)
+	case network.Parent != "" || network.Mode != "" || network.DHCP:
+		return nil, fmt.Errorf("--parent, --mode and --dhcp require the macvlan or ipvlan driver")
+	default:
+		network.Bridge = bridgePrefix + "-" + network.ID[:10]
+	}
+	if name == defaultNetwork {
+		network = defaultNetworkConfig()
+	}
+
+	err := withLockedFile(runtimePath("networks", "networks"), func() error {
+		if fileExists(networkPath(name)) {
+			return fmt.Errorf("network %s already exists", name)
+		}
+
+		existing, err := listNetworks()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case network.Subnet != "":
+		case network.DHCP:
+			// Addresses come from the LAN's DHCP server
+			network.Created = time.Now()
+			return writeJSONFile(networkPath(name), network)
+		case network.isLAN():
+			return fmt.Errorf("a %s network needs the LAN's --subnet, or --dhcp", network.Driver)
+		default:
+			if network.Subnet, err = pickSubnet(existing); err != nil {
+				return err
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(network.Subnet)
+		if err != nil || ipNet.IP.To4() == nil {
+			return fmt.Errorf("invalid IPv4 subnet %s", network.Subnet)
+		}
+		network.Subnet = ipNet.String()
+
+		for _, other := range existing {
+			if subnetsOverlap(network.Subnet, other.Subnet) {
+				return fmt.Errorf("subnet %s overlaps with network %s (%s)", network.Subnet, other.Name, other.Subnet)
+			}
+		}
+
+		if network.Gateway == "" {
+			network.Gateway = firstHostIP(ipNet).String()
+		}
+		if gw := net.ParseIP(network.Gateway); gw == nil || !ipNet.Contains(gw) {
+			return fmt.Errorf("gateway %s is not in subnet %s", network.Gateway, network.Subnet)
+		}
+
+		if network.IPv6Subnet != "" {
+			if err := validateIPv6Subnet(network, existing); err != nil {
+				return err
+			}
+		} else if network.IPv6Gateway != "" {
+			return fmt.Errorf("an IPv6 gateway requires an IPv6 subnet")
+		}
+
+		network.Created = time.Now()
+		return writeJSONFile(networkPath(name), network)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return network, nil
+}
+
+// LoadNetwork reads the named network. The default network is created on first use.
+func LoadNetwork(name string) (*Network, error) {
+	if !fileExists(networkPath(name)) {
+		if name != defaultNetwork {
+			return nil, fmt.Errorf("network %s not found", name)
+		}
+		if _, err := CreateNetwork(&Network{Name: name}); err != nil && !fileExists(networkPath(name)) {
+			return nil, fmt.Errorf("failed to create default network: %v", err)
+		}
+	}
+
+	network := &Network{}
+	if err := readJSONFile(networkPath(name), network); err != nil {
+		return nil, err
+	}
+
+	return network, nil
+}
+
+// ListNetworks returns every defined network sorted by name
+func ListNetworks() ([]*Network, error) {
+	// Make sure the default network always shows up
+	if _, err := LoadNetwork(defaultNetwork); err != nil {
+		return nil, err
+	}
+
+	return listNetworks()
+}
+
+// listNetworks reads every network definition from disk
+func listNetworks() ([]*Network, error) {
+	files, err := ioutil.ReadDir(runtimePath("networks"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read networks: %v", err)
+	}
+
+	var networks []*Network
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		network := &Network{}
+		if err := readJSONFile(runtimePath("networks", file.Name()), network); err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+	return networks, nil
+}
+
+// RemoveNetwork deletes a network, its bridge and its firewall rules. Networks
+// with attached containers can't be removed.
+func RemoveNetwork(name string) error {
+	if name == defaultNetwork {
+		return fmt.Errorf("the default network cannot be removed")
+	}
+
+	network, err := LoadNetwork(name)
+	if err != nil {
+		return err
+	}
+
+	containers, err := NetworkContainers(network)
+	if err != nil {
+		return err
+	}
+	if len(containers) > 0 {
+		return fmt.Errorf("network %s has %d attached container(s)", name, len(containers))
+	}
+
+	// LAN networks have nothing on the host besides the parent interface
+	if !network.isLAN() {
+		if err := cleanupNetworkRules(network); err != nil {
+			return fmt.Errorf("failed to remove firewall rules: %v", err)
+		}
+
+		if bridge, err := netlink.LinkByName(network.Bridge); err == nil {
+			if err := netlink.LinkDel(bridge); err != nil {
+				return fmt.Errorf("failed to delete bridge %s: %v", network.Bridge, err)
+			}
+		}
+	}
+
+	for _, pool := range []string{name, ipv6Pool(name)} {
+		os.Remove(ipamPath(pool))
+		os.Remove(ipamPath(pool) + ".lock")
+	}
+	os.Remove(dnsServerPath(name) + ".lock")
+	os.Remove(runtimePath("dns", name+".log"))
+	if err := os.Remove(networkPath(name)); err != nil {
+		return fmt.Errorf("failed to remove network %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// NetworkContainers returns the containers currently holding an address on the network
+func NetworkContainers(network *Network) ([]NetworkContainer, error) {
+	// Leased addresses aren't tracked by IPAM
+	if network.DHCP {
+		states, err := ListContainerStates()
+		if err != nil {
+			return nil, err
+		}
+
+		containers := []NetworkContainer{}
+		for _, state := range states {
+			if state.Config.Network == network.Name {
+				containers = append(containers, NetworkContainer{ID: state.Config.ID, IP: state.Config.ContainerIP})
+			}
+		}
+		return containers, nil
+	}
+
+	ipPool := &IPPool{}
+	if err := readJSONFile(ipamPath(network.Name), ipPool); err != nil {
+		return nil, err
+	}
+
+	ipv6Addrs := make(map[string]string)
+	if network.IPv6Subnet != "" {
+		v6Pool := &IPPool{}
+		if err := readJSONFile(ipamPath(ipv6Pool(network.Name)), v6Pool); err != nil {
+			return nil, err
+		}
+		v6Pool.dropStale()
+		for ip, id := range v6Pool.Allocated {
+			ipv6Addrs[id] = ip
+		}
+	}
+
+	ipPool.dropStale()
+	containers := []NetworkContainer{}
+	for ip, id := range ipPool.Allocated {
+		containers = append(containers, NetworkContainer{ID: id, IP: ip, IPv6: ipv6Addrs[id]})
+	}
+
+	sort.Slice(containers, func(i, j int) bool { return containers[i].IP < containers[j].IP })
+	return containers, nil
+}
+
+// validateLANNetwork checks the parent, mode and addressing of a macvlan or
+// ipvlan network, filling in the driver's default mode
+func validateLANNetwork(network *Network) error {
+	if network.Parent == "" {
+		return fmt.Errorf("a %s network needs a --parent interface", network.Driver)
+	}
+	if _, err := netlink.LinkByName(network.Parent); err != nil {
+		return fmt.Errorf("parent interface %s not found: %v", network.Parent, err)
+	}
+
+	modes := lanDriverModes[network.Driver]
+	if network.Mode == "" {
+		network.Mode = modes[0]
+	} else if !contains(modes, network.Mode) {
+		return fmt.Errorf("invalid %s mode %s, expected one of %s", network.Driver, network.Mode, strings.Join(modes, ", "))
+	}
+
+	// The host can't talk to its own macvlan and ipvlan interfaces
+	if network.EmbeddedDNS {
+		return fmt.Errorf("embedded DNS requires the bridge driver")
+	}
+
+	if network.DHCP {
+		if network.Subnet != "" || network.Gateway != "" || network.IPv6Subnet != "" {
+			return fmt.Errorf("--dhcp can't be combined with --subnet, --gateway or --ipv6-network")
+		}
+		// Other ipvlan modes don't pass broadcasts
+		if network.Driver == driverIPvlan && network.Mode != "l2" {
+			return fmt.Errorf("--dhcp requires ipvlan mode l2")
+		}
+	}
+
+	return nil
+}
+
+// validateIPv6Subnet normalizes the network's IPv6 subnet and gateway and
+// makes sure the subnet isn't used by another network
+func validateIPv6Subnet(network *Network, existing []*Network) error {
+	_, ipNet, err := net.ParseCIDR(network.IPv6Subnet)
+	if err != nil || ipNet.IP.To4() != nil {
+		return fmt.Errorf("invalid IPv6 subnet %s", network.IPv6Subnet)
+	}
+	if ones, _ := ipNet.Mask.Size(); ones > 126 {
+		return fmt.Errorf("IPv6 subnet %s is too small", network.IPv6Subnet)
+	}
+	network.IPv6Subnet = ipNet.String()
+
+	for _, other := range existing {
+		if subnetsOverlap(network.IPv6Subnet, other.IPv6Subnet) {
+			return fmt.Errorf("IPv6 subnet %s overlaps with network %s (%s)", network.IPv6Subnet, other.Name, other.IPv6Subnet)
+		}
+	}
+
+	if network.IPv6Gateway == "" {
+		network.IPv6Gateway = firstHostIP(ipNet).String()
+	}
+	gw := net.ParseIP(network.IPv6Gateway)
+	if gw == nil || !ipNet.Contains(gw) {
+		return fmt.Errorf("IPv6 gateway %s is not in subnet %s", network.IPv6Gateway, network.IPv6Subnet)
+	}
+	network.IPv6Gateway = gw.String()
+
+	return nil
+}
+
+// pickSubnet returns the first /24 in 172.30.0.0/16 not used by another network
+func pickSubnet(existing []*Network) (string, error) {
+	for i := 0; i < 256; i++ {
+		candidate := fmt.Sprintf("172.30.%d.0/24", i)
+
+		free := true
+		for _, network := range existing {
+			if subnetsOverlap(candidate, network.Subnet) {
+				free = false
+				break
+			}
+		}
+
+		if free {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("no free subnet available, specify one with --subnet")
+}
+
+// subnetsOverlap reports whether two CIDRs share any addresses
+func subnetsOverlap(a, b string) bool {
+	_, netA, errA := net.ParseCIDR(a)
+	_, netB, errB := net.ParseCIDR(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	return netA.Contains(netB.IP) || netB.Contains(netA.IP)
+}
+
+// isNetworkName reports whether value looks like a network name rather than a CIDR
+func isNetworkName(value string) bool {
+	return !strings.Contains(value, "/") && validNetworkName.MatchString(value)
+}
@@ -0,0 +1,277 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Library directories the dynamic loader searches when ld.so.conf and the
+// binary itself don't say otherwise
+var defaultLibraryDirs = []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
+// Account and name service files of a created rootfs, just enough for root
+// and nobody to have names
+var rootfsEtcFiles = []struct {
+	name    string
+	content string
+}{
+	{"passwd", "root:x:0:0:root:/root:/bin/sh\nnobody:x:65534:65534:nobody:/nonexistent:/bin/false\n"},
+	{"group", "root:x:0:\nnogroup:x:65534:\n"},
+	{"nsswitch.conf", "passwd: files\ngroup: files\nshadow: files\nhosts: files dns\nnetworks: files\nprotocols: files\nservices: files\n"},
+}
+
+// ensureEmptyDir creates dir, or checks that it is empty if it exists
+func ensureEmptyDir(dir string) error {
+	if files, err := ioutil.ReadDir(dir); err == nil && len(files) > 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	return nil
+}
+
+// CreateRootFS assembles a minimal rootfs in dir from host executables. Each
+// binary is installed as /bin/NAME, with the shared libraries it needs and
+// the dynamic loader at the paths they have on the host.
+func CreateRootFS(dir string, binaries []string) error {
+	if len(binaries) == 0 {
+		return fmt.Errorf("no binaries to copy from the host")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := ensureEmptyDir(dir); err != nil {
+		return err
+	}
+
+	if err := PrepareRootFS(dir); err != nil {
+		return err
+	}
+	for _, d := range []struct {
+		path string
+		mode os.FileMode
+	}{{"bin", 0755}, {"root", 0700}, {"tmp", 0777 | os.ModeSticky}} {
+		if err := ensureDir(filepath.Join(dir, d.path), 0755); err != nil {
+			return fmt.Errorf("failed to create /%s: %v", d.path, err)
+		}
+		if err := os.Chmod(filepath.Join(dir, d.path), d.mode); err != nil {
+			return err
+		}
+	}
+
+	libraryDirs := hostLibraryDirs()
+	copied := make(map[string]bool) // Host paths already in the rootfs
+	for _, name := range binaries {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return fmt.Errorf("binary %s not found on the host: %v", name, err)
+		}
+		if err := copyHostFile(path, filepath.Join(dir, "bin", filepath.Base(name))); err != nil {
+			return err
+		}
+		if err := copyDependencies(dir, path, libraryDirs, copied); err != nil {
+			return fmt.Errorf("failed to copy the libraries of %s: %v", name, err)
+		}
+		logDebug("Copied %s with its dependencies", path)
+	}
+
+	// The loader finds libraries outside its default directories through
+	// the cache, whose paths match the ones copied
+	if fileExists("/etc/ld.so.cache") {
+		if err := copyHostFile("/etc/ld.so.cache", filepath.Join(dir, "etc/ld.so.cache")); err != nil {
+			return err
+		}
+	}
+	for _, file := range rootfsEtcFiles {
+		if err := ioutil.WriteFile(filepath.Join(dir, "etc", file.name), []byte(file.content), 0644); err != nil {
+			return fmt.Errorf("failed to write /etc/%s: %v", file.name, err)
+		}
+	}
+
+	return nil
+}
+
+// copyDependencies copies the dynamic loader and the shared libraries an ELF
+// binary needs into root, following the libraries' own dependencies. Static
+// binaries have neither.
+func copyDependencies(root, binary string, libraryDirs []string, copied map[string]bool) error {
+	f, err := elf.Open(binary)
+	if err != nil {
+		return fmt.Errorf("%s is not an ELF binary: %v", binary, err)
+	}
+	defer f.Close()
+
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		interp, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			return fmt.Errorf("failed to read the interpreter of %s: %v", binary, err)
+		}
+		if err := copyLibrary(root, strings.TrimRight(string(interp), "\x00"), copied); err != nil {
+			return err
+		}
+	}
+
+	needed, err := f.ImportedLibraries()
+	if err != nil {
+		return fmt.Errorf("failed to read the libraries of %s: %v", binary, err)
+	}
+	dirs := append(elfRunPath(f, binary), libraryDirs...)
+	for _, soname := range needed {
+		lib := findLibrary(soname, dirs, f)
+		if lib == "" {
+			return fmt.Errorf("library %s needed by %s not found", soname, binary)
+		}
+		if copied[lib] {
+			continue
+		}
+		if err := copyLibrary(root, lib, copied); err != nil {
+			return err
+		}
+		if err := copyDependencies(root, lib, libraryDirs, copied); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyLibrary copies a host file to the same path in root, once
+func copyLibrary(root, path string, copied map[string]bool) error {
+	if copied[path] {
+		return nil
+	}
+	copied[path] = true
+	return copyHostFile(path, filepath.Join(root, path))
+}
+
+// elfRunPath returns the directories a binary's RPATH and RUNPATH add to
+// the library search, with $ORIGIN expanded
+func elfRunPath(f *elf.File, binary string) []string {
+	origin := filepath.Dir(binary)
+	if real, err := filepath.EvalSymlinks(binary); err == nil {
+		origin = filepath.Dir(real)
+	}
+
+	var dirs []string
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		paths, _ := f.DynString(tag)
+		for _, path := range paths {
+			for _, dir := range strings.Split(path, ":") {
+				dir = strings.NewReplacer("$ORIGIN", origin, "${ORIGIN}", origin).Replace(dir)
+				if dir != "" {
+					dirs = append(dirs, dir)
+				}
+			}
+		}
+	}
+	return dirs
+}
+
+// findLibrary returns the first library named soname in dirs built for the
+// same architecture as binary, 32-bit libraries often share the names
+func findLibrary(soname string, dirs []string, binary *elf.File) string {
+	for _, dir := range dirs {
+		path := filepath.Join(dir, soname)
+		lib, err := elf.Open(path)
+		if err != nil {
+			continue
+		}
+		matches := lib.Class == binary.Class && lib.Machine == binary.Machine
+		lib.Close()
+		if matches {
+			return path
+		}
+	}
+	return ""
+}
+
+// hostLibraryDirs returns the directories in the host's ld.so.conf, followed
+// by the loader's defaults
+func hostLibraryDirs() []string {
+	dirs := readLdSoConf("/etc/ld.so.conf", 0)
+	return append(dirs, defaultLibraryDirs...)
+}
+
+// readLdSoConf returns the library directories listed in an ld.so.conf
+// file and the files it includes
+func readLdSoConf(path string, depth int) []string {
+	const maxIncludeDepth = 8
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var dirs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "include ") && depth < maxIncludeDepth {
+			pattern := strings.TrimSpace(strings.TrimPrefix(line, "include "))
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			includes, _ := filepath.Glob(pattern)
+			for _, include := range includes {
+				dirs = append(dirs, readLdSoConf(include, depth+1)...)
+			}
+			continue
+		}
+		dirs = append(dirs, line)
+	}
+	return dirs
+}
+
+// copyHostFile copies the file a host path points to into dest, keeping its
+// permissions. Symlinks are followed, dest is always a regular file.
+func copyHostFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", dest, err)
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	return os.Chmod(dest, info.Mode().Perm())
+}
@@ -0,0 +1,221 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// netemLimit is the number of packets netem may hold while delaying them
+const netemLimit = 1000
+
+// ifbName derives the name of the ifb device that shapes traffic leaving the
+// container. Like the veth pair it only uses part of the ID.
+func ifbName(id string) string {
+	suffix := shortID(id)
+	if len(suffix) > 8 {
+		suffix = suffix[:8]
+	}
+	return "ifb" + suffix
+}
+
+// ApplyShaping replaces the shaping on the container's host veth. Traffic to
+// the container is shaped on the veth itself. Traffic from the container
+// arrives as ingress on the veth, which can't be queued, so it is redirected
+// to an ifb device and shaped on the way out of it.
+func ApplyShaping(config *ContainerConfig) error {
+	veth, err := netlink.LinkByName(config.HostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %v", config.HostVeth, err)
+	}
+
+	if err := removeShaping(veth, ifbName(config.ID)); err != nil {
+		return err
+	}
+
+	if !config.Shaping.Enabled() {
+		return nil
+	}
+
+	// Traffic towards the container
+	if err := addShapingQdiscs(veth, config.Shaping); err != nil {
+		return err
+	}
+
+	// Traffic from the container
+	ifb, err := createIfb(ifbName(config.ID))
+	if err != nil {
+		return err
+	}
+
+	if err := addShapingQdiscs(ifb, config.Shaping); err != nil {
+		return err
+	}
+
+	ingress := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: veth.Attrs().Index,
+		Handle:    netlink.MakeHandle(0xffff, 0),
+		Parent:    netlink.HANDLE_INGRESS,
+	}}
+	if err := netlink.QdiscAdd(ingress); err != nil {
+		return fmt.Errorf("failed to add ingress qdisc to %s: %v", config.HostVeth, err)
+	}
+
+	// Match every packet and hand it to the ifb device
+	redirect := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: veth.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Sel: &netlink.TcU32Sel{
+			Keys:  []netlink.TcU32Key{{Mask: 0, Val: 0}},
+			Flags: netlink.TC_U32_TERMINAL,
+		},
+		Actions: []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+	}
+	if err := netlink.FilterAdd(redirect); err != nil {
+		return fmt.Errorf("failed to redirect %s to %s: %v", config.HostVeth, ifb.Attrs().Name, err)
+	}
+
+	return nil
+}
+
+// addShapingQdiscs installs netem for delay and loss at the root of the link,
+// with tbf below it for the rate limit. Either one is left out if unused.
+func addShapingQdiscs(link netlink.Link, shaping NetworkShaping) error {
+	parent := uint32(netlink.HANDLE_ROOT)
+
+	if shaping.Delay > 0 || shaping.Loss > 0 {
+		netem := netlink.NewNetem(netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    parent,
+		}, netlink.NetemQdiscAttrs{
+			Latency: uint32(shaping.Delay.Microseconds()),
+			Loss:    float32(shaping.Loss),
+			Limit:   netemLimit,
+		})
+		if err := netlink.QdiscAdd(netem); err != nil {
+			return fmt.Errorf("failed to add netem qdisc to %s, is the sch_netem module available? %v", link.Attrs().Name, err)
+		}
+		parent = netlink.MakeHandle(1, 1)
+	}
+
+	if shaping.Rate > 0 {
+		rate := shaping.Rate / 8 // tbf works in bytes
+
+		// Allow bursts of a timer tick's worth of traffic, and queue up to 50ms
+		burst := uint32(rate / 250)
+		if burst < 16*1024 {
+			burst = 16 * 1024
+		}
+
+		tbf := &netlink.Tbf{
+			QdiscAttrs: netlink.QdiscAttrs{
+				LinkIndex: link.Attrs().Index,
+				Handle:    netlink.MakeHandle(10, 0),
+				Parent:    parent,
+			},
+			Rate:   rate,
+			Limit:  uint32(rate/20) + burst,
+			Buffer: netlink.Xmittime(rate, burst),
+		}
+		if err := netlink.QdiscAdd(tbf); err != nil {
+			return fmt.Errorf("failed to add tbf qdisc to %s: %v", link.Attrs().Name, err)
+		}
+	}
+
+	return nil
+}
+
+// createIfb creates and brings up an ifb device
+func createIfb(name string) (netlink.Link, error) {
+	if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+		return nil, fmt.Errorf("failed to create %s, is the ifb module available? %v", name, err)
+	}
+
+	ifb, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", name, err)
+	}
+
+	if err := netlink.LinkSetUp(ifb); err != nil {
+		return nil, fmt.Errorf("failed to bring up %s: %v", name, err)
+	}
+
+	return ifb, nil
+}
+
+// removeShaping deletes the qdiscs we installed on the veth and its ifb device
+func removeShaping(veth netlink.Link, ifb string) error {
+	qdiscs, err := netlink.QdiscList(veth)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %s: %v", veth.Attrs().Name, err)
+	}
+
+	for _, qdisc := range qdiscs {
+		attrs := qdisc.Attrs()
+		if attrs.Parent != netlink.HANDLE_ROOT && attrs.Parent != netlink.HANDLE_INGRESS {
+			continue
+		}
+		// The default qdisc has no handle and can't be deleted
+		if attrs.Handle == netlink.HANDLE_NONE {
+			continue
+		}
+		if err := netlink.QdiscDel(qdisc); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s qdisc from %s: %v", qdisc.Type(), veth.Attrs().Name, err)
+		}
+	}
+
+	return deleteIfb(ifb)
+}
+
+// deleteIfb removes an ifb device if it exists
+func deleteIfb(name string) error {
+	link, err := netlink.LinkByName(name)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %v", name, err)
+	}
+
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", name, err)
+	}
+	return nil
+}
+
+// UpdateShaping changes the shaping of a running container and records it in
+// the container's state
+func UpdateShaping(ref string, update func(*NetworkShaping) error) (*ContainerState, error) {
+	state, err := FindContainer(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if !usesBridge(state.Config) || state.Config.HostVeth == "" {
+		return nil, fmt.Errorf("container %s has no network to shape", shortID(state.Config.ID))
+	}
+
+	if err := update(&state.Config.Shaping); err != nil {
+		return nil, err
+	}
+
+	if err := ApplyShaping(state.Config); err != nil {
+		return nil, err
+	}
+
+	if err := writeJSONFile(containerStatePath(state.Config.ID), state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// validContainerName matches the names and aliases accepted by --name and --network-alias
+var validContainerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ContainerState is what the runtime records about a running container
+type ContainerState struct {
+	Config  *ContainerConfig `json:"config"`
+	PID     int              `json:"pid"`
+	Started time.Time        `json:"started"`
+}
+
+// containerStatePath returns the on-disk location of a container's state
+func containerStatePath(id string) string {
+	return runtimePath("containers", id+".json")
+}
+
+// containerDir holds files generated for a container, such as its resolv.conf
+func containerDir(id string) string {
+	return runtimePath("containers", id)
+}
+
+// containerFile returns the path of a file generated for a container
+func containerFile(id, name string) string {
+	return filepath.Join(containerDir(id), name)
+}
+
+// SaveContainerState records a started container so other commands can find it
+func SaveContainerState(config *ContainerConfig, pid int) error {
+	state := &ContainerState{Config: config, PID: pid, Started: time.Now()}
+	return writeJSONFile(containerStatePath(config.ID), state)
+}
+
+// RemoveContainerState forgets a container once it has exited
+func RemoveContainerState(id string) error {
+	if err := os.Remove(containerStatePath(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove container state: %v", err)
+	}
+	if err := os.RemoveAll(containerDir(id)); err != nil {
+		return fmt.Errorf("failed to remove container files: %v", err)
+	}
+	return nil
+}
+
+// ListContainerStates returns every running container. State left behind by
+// containers whose process is gone is skipped.
+func ListContainerStates() ([]*ContainerState, error) {
+	files, err := ioutil.ReadDir(runtimePath("containers"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read containers: %v", err)
+	}
+
+	var states []*ContainerState
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		state := &ContainerState{}
+		if err := readJSONFile(runtimePath("containers", file.Name()), state); err != nil {
+			return nil, err
+		}
+		if state.Config == nil || !processAlive(state.PID) {
+			continue
+		}
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Started.Before(states[j].Started) })
+	return states, nil
+}
+
+// FindContainer looks up a running container by name, or by full or abbreviated ID
+func FindContainer(ref string) (*ContainerState, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("no container specified")
+	}
+
+	states, err := ListContainerStates()
+	if err != nil {
+		return nil, err
+	}
+
+	if state := containerByName(states, ref); state != nil {
+		return state, nil
+	}
+
+	var found *ContainerState
+	for _, state := range states {
+		if !strings.HasPrefix(state.Config.ID, ref) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("container reference %s is ambiguous", ref)
+		}
+		found = state
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no running container matches %s", ref)
+	}
+	return found, nil
+}
+
+// containerByName returns the container with the given name, or nil
+func containerByName(states []*ContainerState, name string) *ContainerState {
+	for _, state := range states {
+		if state.Config.Name != "" && state.Config.Name == name {
+			return state
+		}
+	}
+	return nil
+}
+
+// processAlive reports whether a process with the given PID exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
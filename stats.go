@@ -0,0 +1,158 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// NetworkStats are a container's traffic counters, from the container's
+// point of view: received bytes are those the host sent down its veth
+type NetworkStats struct {
+	RxBytes     uint64         `json:"rx_bytes"`
+	TxBytes     uint64         `json:"tx_bytes"`
+	RxPackets   uint64         `json:"rx_packets"`
+	TxPackets   uint64         `json:"tx_packets"`
+	RxDropped   uint64         `json:"rx_dropped"`
+	TxDropped   uint64         `json:"tx_dropped"`
+	RxErrors    uint64         `json:"rx_errors"`
+	TxErrors    uint64         `json:"tx_errors"`
+	Connections map[string]int `json:"connections"` // Tracked connections by protocol
+}
+
+// protocolNames names the protocols conntrack tracks connections for
+var protocolNames = map[uint8]string{
+	unix.IPPROTO_TCP:    "tcp",
+	unix.IPPROTO_UDP:    "udp",
+	unix.IPPROTO_ICMP:   "icmp",
+	unix.IPPROTO_ICMPV6: "icmpv6",
+	unix.IPPROTO_SCTP:   "sctp",
+}
+
+// CollectNetworkStats reads the counters of every container with a network of
+// its own, keyed by container ID. Containers sharing the host's or another
+// container's network are left out, their traffic can't be told apart, and
+// so are containers whose veth is already gone.
+func CollectNetworkStats(configs []*ContainerConfig) (map[string]*NetworkStats, error) {
+	flows, err := conntrackFlows()
+	if err != nil {
+		// Nothing is tracked until the conntrack module is loaded
+		logDebug("Failed to list tracked connections: %v", err)
+	}
+
+	all := make(map[string]*NetworkStats)
+	for _, config := range configs {
+		if !usesBridge(config) || config.HostVeth == "" {
+			continue
+		}
+
+		// A container that exited since it was listed has no veth left, it
+		// gets no counters rather than failing the others
+		link, err := netlink.LinkByName(config.HostVeth)
+		if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+			logDebug("Skipping network stats of %s: %v", shortID(config.ID), err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %v", config.HostVeth, err)
+		}
+
+		// The host's transmit counters are the container's receive counters
+		stats := &NetworkStats{Connections: make(map[string]int)}
+		if counters := link.Attrs().Statistics; counters != nil {
+			stats.RxBytes, stats.TxBytes = counters.TxBytes, counters.RxBytes
+			stats.RxPackets, stats.TxPackets = counters.TxPackets, counters.RxPackets
+			stats.RxDropped, stats.TxDropped = counters.TxDropped, counters.RxDropped
+			stats.RxErrors, stats.TxErrors = counters.TxErrors, counters.RxErrors
+		}
+
+		for _, flow := range flows {
+			if ownsFlow(config, flow) {
+				stats.Connections[protocolName(flow.Forward.Protocol)]++
+			}
+		}
+
+		all[config.ID] = stats
+	}
+
+	return all, nil
+}
+
+// conntrackFlows dumps the IPv4 and IPv6 connection tracking tables
+func conntrackFlows() ([]*netlink.ConntrackFlow, error) {
+	var flows []*netlink.ConntrackFlow
+	for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+		familyFlows, err := netlink.ConntrackTableList(netlink.ConntrackTable, family)
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, familyFlows...)
+	}
+	return flows, nil
+}
+
+// ownsFlow reports whether a connection was made by or to the container.
+// Connections to published ports only show the container as the source of
+// the reply, after DNAT.
+func ownsFlow(config *ContainerConfig, flow *netlink.ConntrackFlow) bool {
+	for _, addr := range []string{config.ContainerIP, config.ContainerIPv6} {
+		if addr == "" {
+			continue
+		}
+		if flow.Forward.SrcIP.String() == addr || flow.Reverse.SrcIP.String() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolName returns the name of an IP protocol, or its number if unknown
+func protocolName(proto uint8) string {
+	if name, ok := protocolNames[proto]; ok {
+		return name
+	}
+	return strconv.Itoa(int(proto))
+}
+
+// formatConnections formats connection counts as "tcp 3, udp 1"
+func formatConnections(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "-"
+	}
+
+	protocols := make([]string, 0, len(counts))
+	for proto := range counts {
+		protocols = append(protocols, proto)
+	}
+	sort.Strings(protocols)
+
+	parts := make([]string, len(protocols))
+	for i, proto := range protocols {
+		parts[i] = fmt.Sprintf("%s %d", proto, counts[proto])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatBytes formats a byte count with a decimal unit, like 1.5MB
+func formatBytes(bytes uint64) string {
+	const unit = 1000
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	value, suffix := float64(bytes)/unit, "kB"
+	for _, next := range []string{"MB", "GB", "TB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+	return fmt.Sprintf("%.1f%s", value, suffix)
+}
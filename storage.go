@@ -0,0 +1,122 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// StorageStats is how much of its writable layer a container uses
+type StorageStats struct {
+	Size uint64 `json:"size"`
+	Used uint64 `json:"used"`
+}
+
+// storageImage returns the ext4 image holding a container's writable layer
+func storageImage(id string) string {
+	return containerFile(id, "storage.img")
+}
+
+// storageDir returns where the container's storage image is mounted on the
+// host, with the overlay's upper and work directories inside
+func storageDir(id string) string {
+	return containerFile(id, "storage")
+}
+
+// storageRoot returns the mount point of the container's overlay root
+func storageRoot(id string) string {
+	return containerFile(id, "rootfs")
+}
+
+// SetupStorage creates the writable layer of a container with a storage
+// size: an ext4 image of that size mounted on the host, which the child
+// overlays on the rootfs. The rootfs itself is never written to.
+func SetupStorage(config *ContainerConfig) error {
+	if config.StorageSize == 0 {
+		return nil
+	}
+
+	// Overlay options are separated by commas and lower directories by colons
+	rootFS, err := filepath.Abs(config.RootFS)
+	if err != nil {
+		return fmt.Errorf("failed to resolve rootfs path: %v", err)
+	}
+	if strings.ContainsAny(rootFS, ",:") {
+		return fmt.Errorf("--storage-size needs a rootfs path without commas or colons, not %s", rootFS)
+	}
+	config.RootFS = rootFS
+
+	if err := ensureDir(storageDir(config.ID), 0700); err != nil {
+		return fmt.Errorf("failed to create storage directory: %v", err)
+	}
+	if err := createExt4Image(storageImage(config.ID), config.StorageSize); err != nil {
+		return err
+	}
+	if err := mountImage(storageImage(config.ID), storageDir(config.ID), 0); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(storageDir(config.ID), "lost+found"))
+
+	for _, dir := range []string{filepath.Join(storageDir(config.ID), "upper"), filepath.Join(storageDir(config.ID), "work"), storageRoot(config.ID)} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			CleanupStorage(config)
+			return fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// mountStorage mounts the container's root as an overlay of the rootfs and
+// its writable layer, and makes it the rootfs for the rest of the setup.
+// Runs in the container's mount namespace.
+func mountStorage(config *ContainerConfig) error {
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", config.RootFS,
+		filepath.Join(storageDir(config.ID), "upper"), filepath.Join(storageDir(config.ID), "work"))
+	if err := syscall.Mount("overlay", storageRoot(config.ID), "overlay", 0, data); err != nil {
+		return fmt.Errorf("failed to mount overlay root, is the overlay module available? %v", err)
+	}
+
+	config.RootFS = storageRoot(config.ID)
+	return nil
+}
+
+// CleanupStorage unmounts the container's writable layer and deletes it
+func CleanupStorage(config *ContainerConfig) {
+	if config.StorageSize == 0 {
+		return
+	}
+
+	if isMountPoint(storageDir(config.ID)) {
+		if err := syscall.Unmount(storageDir(config.ID), 0); err != nil {
+			logError("Failed to unmount storage of container %s: %v", shortID(config.ID), err)
+			return
+		}
+	}
+	if err := os.Remove(storageImage(config.ID)); err != nil && !os.IsNotExist(err) {
+		logError("Failed to remove storage of container %s: %v", shortID(config.ID), err)
+	}
+}
+
+// CollectStorageStats returns the size and usage of a container's writable
+// layer, or nil if it writes to its rootfs directly
+func CollectStorageStats(config *ContainerConfig) (*StorageStats, error) {
+	if config.StorageSize == 0 {
+		return nil, nil
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(storageDir(config.ID), &st); err != nil {
+		return nil, fmt.Errorf("failed to get storage usage of container %s: %v", shortID(config.ID), err)
+	}
+
+	return &StorageStats{
+		Size: config.StorageSize,
+		Used: (st.Blocks - st.Bfree) * uint64(st.Bsize),
+	}, nil
+}
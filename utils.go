@@ -4,6 +4,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
@@ -45,6 +47,23 @@ func parsePID(pidStr string) (int, error) {
 	return pid, nil
 }
 
+// generateID returns a random hex identifier for a new container or network
+func generateID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("error: failed to generate container ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// shortID truncates a container ID to the length used in interface names and output
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
 // fileExists checks if a file exists
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
@@ -94,21 +113,77 @@ func validateCommand(command []string) error {
 // printConfig prints the container configuration in a readable format
 func printConfig(config *ContainerConfig) {
 	fmt.Printf("Container Configuration:\n")
+	fmt.Printf("  ID: %s\n", config.ID)
+	if config.Name != "" {
+		fmt.Printf("  Name: %s\n", config.Name)
+	}
 	fmt.Printf("  Hostname: %s\n", config.Hostname)
-	fmt.Printf("  Root FS: %s\n", config.RootFS)
-	fmt.Printf("  Network: %s\n", config.NetworkCIDR)
-	fmt.Printf("  Host IP: %s\n", config.HostIP)
-	fmt.Printf("  Container IP: %s\n", config.ContainerIP)
+	if config.ReadOnly {
+		fmt.Printf("  Root FS: %s (read-only)\n", config.RootFS)
+	} else {
+		fmt.Printf("  Root FS: %s\n", config.RootFS)
+	}
+	fmt.Printf("  Network: %s\n", config.Network)
+	if len(config.NetworkAliases) > 0 {
+		fmt.Printf("  Network Aliases: %s\n", strings.Join(config.NetworkAliases, ", "))
+	}
+	if config.EgressIface != "" {
+		fmt.Printf("  Egress Interface: %s\n", config.EgressIface)
+	}
+	if config.ContainerIP != "" {
+		fmt.Printf("  Container IP: %s\n", config.ContainerIP)
+	} else {
+		fmt.Printf("  Container IP: (allocated at startup)\n")
+	}
+	if config.ContainerIPv6 != "" {
+		fmt.Printf("  Container IPv6: %s\n", config.ContainerIPv6)
+	}
+	if len(config.DNS) > 0 {
+		fmt.Printf("  DNS: %s\n", strings.Join(config.DNS, ", "))
+	}
+	if len(config.DNSSearch) > 0 {
+		fmt.Printf("  DNS Search: %s\n", strings.Join(config.DNSSearch, ", "))
+	}
+	if config.Shaping.Enabled() {
+		fmt.Printf("  Network Shaping: %s\n", config.Shaping)
+	}
+	if config.DenyEgress {
+		allowed := "nothing"
+		if len(config.AllowEgress) > 0 {
+			var rules []string
+			for _, rule := range config.AllowEgress {
+				rules = append(rules, rule.String())
+			}
+			allowed = strings.Join(rules, ", ")
+		}
+		fmt.Printf("  Egress: denied, allowed to %s\n", allowed)
+	}
+	if config.StorageSize > 0 {
+		fmt.Printf("  Storage Size: %s\n", formatBytes(config.StorageSize))
+	}
+	if config.WritableSys {
+		fmt.Printf("  /sys: writable\n")
+	}
 	fmt.Printf("  Command: %s\n", strings.Join(config.Command, " "))
 
+	if len(config.Ports) > 0 {
+		fmt.Printf("  Ports:\n")
+		for _, port := range config.Ports {
+			fmt.Printf("    %s\n", port)
+		}
+	}
+
 	if len(config.Mounts) > 0 {
 		fmt.Printf("  Mounts:\n")
 		for _, mount := range config.Mounts {
-			readOnly := ""
-			if mount.ReadOnly {
-				readOnly = " (read-only)"
-			}
-			fmt.Printf("    %s -> %s%s\n", mount.Source, mount.Destination, readOnly)
+			fmt.Printf("    %s\n", mount)
+		}
+	}
+
+	if len(config.Devices) > 0 {
+		fmt.Printf("  Devices:\n")
+		for _, device := range config.Devices {
+			fmt.Printf("    %s\n", device)
 		}
 	}
 }
@@ -0,0 +1,333 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// validVolumeName matches the names of named volumes
+var validVolumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// minVolumeSize is the smallest quota, ext4 needs room for its own metadata
+const minVolumeSize = 4 * 1000 * 1000
+
+// Volume is a named volume, a directory under the runtime's state that
+// outlives containers. Volumes with a size are an ext4 image mounted on that
+// directory, so their data can't grow past it.
+type Volume struct {
+	Name    string    `json:"name"`
+	Size    uint64    `json:"size,omitempty"` // Quota in bytes, 0 for none
+	Created time.Time `json:"created"`
+	// Refs maps the containers mounting the volume to the runtime process
+	// waiting for each, a reference is stale once that process is gone
+	Refs map[string]int `json:"refs,omitempty"`
+}
+
+// volumeDir holds a volume's definition and data
+func volumeDir(name string) string {
+	return runtimePath("volumes", name)
+}
+
+// volumePath returns the directory holding a named volume's data
+func volumePath(name string) string {
+	return filepath.Join(volumeDir(name), "data")
+}
+
+// volumeImage returns the ext4 image backing a volume with a quota
+func volumeImage(name string) string {
+	return filepath.Join(volumeDir(name), "disk.img")
+}
+
+// volumeConfigPath returns the on-disk location of a volume's definition
+func volumeConfigPath(name string) string {
+	return filepath.Join(volumeDir(name), "volume.json")
+}
+
+// withVolumesLocked runs fn while no other runtime process changes volumes
+func withVolumesLocked(fn func() error) error {
+	return withLockedFile(runtimePath("volumes"), fn)
+}
+
+// CreateVolume creates a named volume, with a quota unless size is 0
+func CreateVolume(name string, size uint64) (*Volume, error) {
+	if !validVolumeName.MatchString(name) {
+		return nil, fmt.Errorf("invalid volume name %q", name)
+	}
+	if size != 0 && size < minVolumeSize {
+		return nil, fmt.Errorf("volume size must be at least %s", formatBytes(minVolumeSize))
+	}
+
+	var volume *Volume
+	err := withVolumesLocked(func() error {
+		if fileExists(volumeDir(name)) {
+			return fmt.Errorf("volume %s already exists", name)
+		}
+
+		var err error
+		volume, err = createVolume(name, size)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return volume, nil
+}
+
+// createVolume creates the volume's data directory and image. The volumes
+// lock must be held.
+func createVolume(name string, size uint64) (*Volume, error) {
+	volume := &Volume{Name: name, Size: size, Created: time.Now()}
+	if err := ensureDir(volumePath(name), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create volume %s: %v", name, err)
+	}
+
+	if size > 0 {
+		if err := createExt4Image(volumeImage(name), size); err != nil {
+			os.RemoveAll(volumeDir(name))
+			return nil, err
+		}
+		if err := mountVolumeImage(volume); err != nil {
+			os.RemoveAll(volumeDir(name))
+			return nil, err
+		}
+		// Nobody needs fsck's directory in their volume, fsck recreates it if needed
+		os.Remove(filepath.Join(volumePath(name), "lost+found"))
+	}
+
+	if err := writeJSONFile(volumeConfigPath(name), volume); err != nil {
+		removeVolume(volume)
+		return nil, err
+	}
+
+	return volume, nil
+}
+
+// mountVolumeImage mounts a volume's image on its data directory, unless the
+// volume has no quota or the image is still mounted
+func mountVolumeImage(volume *Volume) error {
+	if volume.Size == 0 || isMountPoint(volumePath(volume.Name)) {
+		return nil
+	}
+	return mountImage(volumeImage(volume.Name), volumePath(volume.Name), 0)
+}
+
+// LoadVolume reads the named volume
+func LoadVolume(name string) (*Volume, error) {
+	if !validVolumeName.MatchString(name) || !dirExists(volumeDir(name)) {
+		return nil, fmt.Errorf("volume %s not found", name)
+	}
+
+	volume := &Volume{Name: name}
+	if err := readJSONFile(volumeConfigPath(name), volume); err != nil {
+		return nil, err
+	}
+
+	return volume, nil
+}
+
+// ListVolumes returns every volume sorted by name
+func ListVolumes() ([]*Volume, error) {
+	files, err := ioutil.ReadDir(runtimePath("volumes"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volumes: %v", err)
+	}
+
+	var volumes []*Volume
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		volume, err := LoadVolume(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, volume)
+	}
+
+	return volumes, nil
+}
+
+// users returns the IDs of the running containers mounting the volume
+func (v *Volume) users() []string {
+	var ids []string
+	for id, pid := range v.Refs {
+		if processAlive(pid) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// usage returns how many bytes the volume's data takes up
+func (v *Volume) usage() (uint64, error) {
+	path := volumePath(v.Name)
+	if v.Size > 0 {
+		if isMountPoint(path) {
+			var st syscall.Statfs_t
+			if err := syscall.Statfs(path, &st); err != nil {
+				return 0, fmt.Errorf("failed to get usage of volume %s: %v", v.Name, err)
+			}
+			return (st.Blocks - st.Bfree) * uint64(st.Bsize), nil
+		}
+
+		// Unmounted since the host rebooted, the image's allocated blocks are close enough
+		path = volumeImage(v.Name)
+	}
+
+	var used uint64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			used += uint64(st.Blocks) * 512
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get usage of volume %s: %v", v.Name, err)
+	}
+	return used, nil
+}
+
+// AcquireVolumes creates the volumes mounted by the container that don't
+// exist yet, mounts their images and records the container as a user
+func AcquireVolumes(config *ContainerConfig) error {
+	return withVolumesLocked(func() error {
+		for _, mount := range config.Mounts {
+			if mount.mountType() != mountVolume {
+				continue
+			}
+
+			var volume *Volume
+			var err error
+			if dirExists(volumeDir(mount.Source)) {
+				volume, err = LoadVolume(mount.Source)
+			} else if volume, err = createVolume(mount.Source, 0); err == nil {
+				logInfo("Created volume %s", mount.Source)
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := mountVolumeImage(volume); err != nil {
+				return err
+			}
+
+			// Drop references left behind by runtime processes that were killed
+			if volume.Refs == nil {
+				volume.Refs = make(map[string]int)
+			}
+			for id, pid := range volume.Refs {
+				if !processAlive(pid) {
+					delete(volume.Refs, id)
+				}
+			}
+			volume.Refs[config.ID] = os.Getpid()
+			if err := writeJSONFile(volumeConfigPath(volume.Name), volume); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReleaseVolumes forgets the container as a user of its volumes
+func ReleaseVolumes(config *ContainerConfig) {
+	err := withVolumesLocked(func() error {
+		for _, mount := range config.Mounts {
+			if mount.mountType() != mountVolume || !dirExists(volumeDir(mount.Source)) {
+				continue
+			}
+
+			volume, err := LoadVolume(mount.Source)
+			if err != nil {
+				return err
+			}
+			delete(volume.Refs, config.ID)
+			if err := writeJSONFile(volumeConfigPath(volume.Name), volume); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logError("Failed to release volumes: %v", err)
+	}
+}
+
+// RemoveVolume deletes a volume and its data, unless a container uses it
+func RemoveVolume(name string) error {
+	return withVolumesLocked(func() error {
+		volume, err := LoadVolume(name)
+		if err != nil {
+			return err
+		}
+
+		if users := volume.users(); len(users) > 0 {
+			for i, id := range users {
+				users[i] = shortID(id)
+			}
+			return fmt.Errorf("volume %s is in use by container(s) %s", name, strings.Join(users, ", "))
+		}
+
+		return removeVolume(volume)
+	})
+}
+
+// PruneVolumes deletes every volume no container uses and returns their names
+func PruneVolumes() ([]string, error) {
+	var removed []string
+	err := withVolumesLocked(func() error {
+		volumes, err := ListVolumes()
+		if err != nil {
+			return err
+		}
+
+		for _, volume := range volumes {
+			if len(volume.users()) > 0 {
+				continue
+			}
+			if err := removeVolume(volume); err != nil {
+				return err
+			}
+			removed = append(removed, volume.Name)
+		}
+		return nil
+	})
+
+	return removed, err
+}
+
+// removeVolume unmounts a volume's image and deletes its directory. The
+// volumes lock must be held.
+func removeVolume(volume *Volume) error {
+	path := volumePath(volume.Name)
+	if isMountPoint(path) {
+		if err := syscall.Unmount(path, 0); err != nil {
+			return fmt.Errorf("failed to unmount volume %s: %v", volume.Name, err)
+		}
+	}
+
+	if err := os.RemoveAll(volumeDir(volume.Name)); err != nil {
+		return fmt.Errorf("failed to remove volume %s: %v", volume.Name, err)
+	}
+
+	return nil
+}